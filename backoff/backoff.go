@@ -14,6 +14,12 @@ type Config struct {
 	Max time.Duration
 	// MaxAttempts is the maximum total number of attempts (required)
 	MaxAttempts int
+	// OnRetry is called with the attempt number, the upcoming delay and the attempt's error
+	// after each failed attempt that will be retried (optional)
+	OnRetry func(attempt int, delay time.Duration, err error)
+	// OnGiveUp is called with the number of attempts and the last attempt's error when
+	// the maximum number of attempts is reached (optional)
+	OnGiveUp func(attempts int, err error)
 }
 
 // Run tries to run func f with the configured back-off until it either
@@ -27,12 +33,18 @@ func (config Config) Run(ctx context.Context, f func() error) error {
 			return nil
 		}
 		if i > config.MaxAttempts {
+			if config.OnGiveUp != nil {
+				config.OnGiveUp(i, err)
+			}
 			return err
 		}
 		delay *= backOffFactor
 		if delay > config.Max {
 			delay = config.Max
 		}
+		if config.OnRetry != nil {
+			config.OnRetry(i, delay, err)
+		}
 		select {
 		case <-time.After(delay):
 		case <-ctx.Done():
@@ -0,0 +1,64 @@
+package sshtunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Cert obtains and returns the configured certificate.
+func (a KeySource) Cert() (*ssh.Certificate, error) {
+	var buf []byte
+	name := "(inline)"
+	switch {
+	case a.Certificate != nil:
+		buf = *a.Certificate
+	case a.CertificatePath != nil:
+		name = *a.CertificatePath
+		var err error
+		buf, err = ioutil.ReadFile(*a.CertificatePath)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("no ssh certificate defined")
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh certificate %s: %v", name, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("parse ssh certificate %s: not a certificate, but a %s key", name, pub.Type())
+	}
+	return cert, nil
+}
+
+// certSigner validates the user certificate against the key and the time `now`, and combines both into a signer.
+func certSigner(cert *ssh.Certificate, key ssh.Signer, now time.Time) (ssh.Signer, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("ssh certificate %q: not a user certificate", cert.KeyId)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("ssh certificate %q: certified key %s does not match private key %s",
+			cert.KeyId, ssh.FingerprintSHA256(cert.Key), ssh.FingerprintSHA256(key.PublicKey()))
+	}
+	unix := now.Unix()
+	if unix < 0 || uint64(unix) < cert.ValidAfter {
+		return nil, fmt.Errorf("ssh certificate %q: not valid before %v", cert.KeyId, certTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && uint64(unix) >= cert.ValidBefore {
+		return nil, fmt.Errorf("ssh certificate %q: expired at %v", cert.KeyId, certTime(cert.ValidBefore))
+	}
+	return ssh.NewCertSigner(cert, key)
+}
+
+func certTime(t uint64) time.Time {
+	if t > uint64(1<<63-1) {
+		t = uint64(1<<63 - 1)
+	}
+	return time.Unix(int64(t), 0)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -12,44 +13,150 @@ import (
 // Config is an SSH tunnel configuration.
 //
 // When `SSHConn` is set to a non-nil net.Conn, that connection is reused instead of opening a new one.
+// When `Jumps` are given, the connection to SSHAddr is tunneled through each of them in turn.
 type Config struct {
 	// SSHAddr is the host:port address of the SSH server (required).
 	SSHAddr string
 	// SSHClient is the ssh.Client config (required).
 	SSHClient *ssh.ClientConfig
+	// Auth is the authentication configuration (optional).
+	// When set, it replaces SSHClient.Auth, and its methods are evaluated anew for each connection.
+	Auth *ConfigAuth
 	// SSHConn is a pre-existing connection to an SSH server (optional).
+	// When Jumps is non-empty, it is a connection to the first jump host instead.
 	SSHConn net.Conn
+	// Jumps are the jump hosts to connect through, in order, before reaching SSHAddr (optional).
+	Jumps []JumpHost
+	// KeepAlive enables keepalive requests on the SSH connection (optional).
+	KeepAlive *ConfigKeepAlive
+	// Observer receives lifecycle events of connections made using this configuration (optional).
+	Observer Observer
+	// ForwardAgent is an agent (such as an *Agent) to forward to the SSH server (optional).
+	// Sessions opened on the client must still request forwarding via agent.RequestAgentForwarding.
+	ForwardAgent agent.Agent
+	// LocalForwards are the local forwardings declared for the host (optional).
+	// They are informational only (see ConfigFromSSHConfig) and are not set up by Dial or Listen.
+	LocalForwards []LocalForward
 }
 
+// LocalForward is a local port forwarding specification, as in OpenSSH's LocalForward.
+type LocalForward struct {
+	// Local is the local address to listen on.
+	Local net.Addr
+	// Network is the network of the remote endpoint ("tcp" or "unix").
+	Network string
+	// Addr is the address of the remote endpoint.
+	Addr string
+}
+
+// JumpHost is an intermediate SSH server (as in OpenSSH's ProxyJump).
+type JumpHost struct {
+	// Addr is the host:port address of the jump host (required).
+	Addr string
+	// SSHClient is the ssh.Client config for the jump host (optional).
+	// When nil, Config.SSHClient is used.
+	SSHClient *ssh.ClientConfig
+}
+
+// SSH authentication method names, as used in ConfigAuth.Order.
+const (
+	AuthMethodPassword            = "password"
+	AuthMethodPublicKey           = "publickey"
+	AuthMethodKeyboardInteractive = "keyboard-interactive"
+)
+
 // ConfigAuth is an authentication configuration for an SSH tunnel.
+//
+// Order lists the names of auth methods in the order they should be tried; methods not listed
+// are tried afterwards, in the default order password, publickey, keyboard-interactive.
+// For servers requiring multiple methods (e.g. publickey followed by keyboard-interactive),
+// the methods are continued in this order after each partial success.
+//
+// Keys are obtained from SSHAgent (see ConfigSSHAgent.Keys), from the long-lived Agent, and from Keys.
 type ConfigAuth struct {
-	Password *string
-	SSHAgent *ConfigSSHAgent
-	Keys     []KeySource
+	Password            *string
+	SSHAgent            *ConfigSSHAgent
+	Agent               *Agent
+	Keys                []KeySource
+	KeyboardInteractive ssh.KeyboardInteractiveChallenge
+	Order               []string
 }
 
 // ConfigSSHAgent is the configuration for an ssh-agent connection.
+//
+// When Addr is nil, the address is taken from the SSH_AUTH_SOCK environment variable.
+// When Comments or Fingerprints are given, only keys matching one of them are used.
 type ConfigSSHAgent struct {
-	Addr       net.Addr
-	Passphrase *[]byte
+	Addr         net.Addr
+	Passphrase   *[]byte
+	Comments     []string
+	Fingerprints []string
 }
 
 // KeySource is the configuration of an ssh key.
 //
 // Either Signer, or one of PEM and Path must be set.
 // If PEM or Path are set and the referred key is encrypted, Passphrase must also be set.
+//
+// Optionally, one of Certificate and CertificatePath may be set to an OpenSSH user certificate
+// (the contents or path of a `-cert.pub` file) for the key.
 type KeySource struct {
-	PEM        *[]byte
-	Path       *string
-	Passphrase *[]byte
-	Signer     ssh.Signer
+	PEM             *[]byte
+	Path            *string
+	Passphrase      *[]byte
+	Signer          ssh.Signer
+	Certificate     *[]byte
+	CertificatePath *string
 }
 
 // Methods returns the configured SSH auth methods.
 func (a ConfigAuth) Methods() (out []ssh.AuthMethod, err error) {
+	return a.methods(func(string) {})
+}
+
+// methods returns the configured SSH auth methods, calling trace with the method name whenever a method is attempted.
+func (a ConfigAuth) methods(trace func(method string)) (out []ssh.AuthMethod, err error) {
+	methods := make(map[string]ssh.AuthMethod)
 	if a.Password != nil {
-		out = append(out, ssh.Password(*a.Password))
+		password := *a.Password
+		methods[AuthMethodPassword] = ssh.PasswordCallback(func() (string, error) {
+			trace(AuthMethodPassword)
+			return password, nil
+		})
+	}
+	keys, err := a.Signers()
+	if err != nil {
+		return nil, err
 	}
+	if len(keys) > 0 {
+		methods[AuthMethodPublicKey] = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			trace(AuthMethodPublicKey)
+			return keys, nil
+		})
+	}
+	if a.KeyboardInteractive != nil {
+		challenge := a.KeyboardInteractive
+		methods[AuthMethodKeyboardInteractive] = ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			trace(AuthMethodKeyboardInteractive)
+			return challenge(user, instruction, questions, echos)
+		})
+	}
+	order := append(append([]string(nil), a.Order...), AuthMethodPassword, AuthMethodPublicKey, AuthMethodKeyboardInteractive)
+	for _, name := range order {
+		method, ok := methods[name]
+		switch {
+		case ok:
+			out = append(out, method)
+			delete(methods, name)
+		case name != AuthMethodPassword && name != AuthMethodPublicKey && name != AuthMethodKeyboardInteractive:
+			return nil, fmt.Errorf("unknown ssh auth method %q", name)
+		}
+	}
+	return
+}
+
+// Signers returns the keys from the configured ssh agent and key sources.
+func (a ConfigAuth) Signers() ([]ssh.Signer, error) {
 	var keys []ssh.Signer
 	if a.SSHAgent != nil {
 		agentKeys, err := a.SSHAgent.Keys()
@@ -58,6 +165,13 @@ func (a ConfigAuth) Methods() (out []ssh.AuthMethod, err error) {
 		}
 		keys = append(keys, agentKeys...)
 	}
+	if a.Agent != nil {
+		agentKeys, err := a.Agent.Signers()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, agentKeys...)
+	}
 	if a.Keys != nil {
 		for _, k := range a.Keys {
 			key, err := k.Key()
@@ -67,34 +181,37 @@ func (a ConfigAuth) Methods() (out []ssh.AuthMethod, err error) {
 			keys = append(keys, key)
 		}
 	}
-	if len(keys) > 0 {
-		out = append(out, ssh.PublicKeys(keys...))
-	}
-	return
+	return keys, nil
 }
 
-// Keys obtains and returns all keys from the configured ssh agent.
+// Keys obtains and returns all (matching) keys from the configured ssh agent.
+//
+// The keys sign via an Agent that connects to the ssh-agent for each request and holds no connection
+// in between. Use NewAgent directly for a long-lived agent connection.
 func (a ConfigSSHAgent) Keys() ([]ssh.Signer, error) {
-	conn, err := net.Dial(a.Addr.Network(), a.Addr.String())
+	return newTransientAgent(a).Signers()
+}
+
+// Key obtains and returns the configured key.
+//
+// If a certificate is configured, the returned key presents the certificate. An error is returned
+// if the certificate does not match the key or is not currently valid.
+func (a KeySource) Key() (ssh.Signer, error) {
+	key, err := a.privateKey()
 	if err != nil {
 		return nil, err
 	}
-	sshAgent := agent.NewClient(conn)
-	signers, err := sshAgent.Signers()
-	if err == nil {
-		return signers, nil
+	if a.Certificate == nil && a.CertificatePath == nil {
+		return key, nil
 	}
-	if a.Passphrase == nil {
-		return nil, err
-	}
-	if err := sshAgent.Unlock(*a.Passphrase); err != nil {
+	cert, err := a.Cert()
+	if err != nil {
 		return nil, err
 	}
-	return sshAgent.Signers()
+	return certSigner(cert, key, time.Now())
 }
 
-// Key obtains and returns the configured key.
-func (a KeySource) Key() (ssh.Signer, error) {
+func (a KeySource) privateKey() (ssh.Signer, error) {
 	switch {
 	case a.Signer != nil:
 		return a.Signer, nil
@@ -2,43 +2,235 @@ package connpipe
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgreben/sshtunnel/tokenbucket"
+)
+
+// Config is a connection pipe configuration.
+type Config struct {
+	// IdleTimeout is the duration without data transferred in either direction after which
+	// both connections are closed (optional, 0 for no timeout)
+	IdleTimeout time.Duration
+	// MaxLifetime is the duration after which both connections are closed, regardless of
+	// activity (optional, 0 for no limit)
+	MaxLifetime time.Duration
+	// LimitAtoB are token buckets limiting the rate (in bytes per second) of data copied from a to b.
+	// Each chunk of data waits for all of the buckets (optional)
+	LimitAtoB []*tokenbucket.Bucket
+	// LimitBtoA are token buckets limiting the rate (in bytes per second) of data copied from b to a.
+	// Each chunk of data waits for all of the buckets (optional)
+	LimitBtoA []*tokenbucket.Bucket
+	// Tap is called at the start of each two-way copy and returns a Tap receiving a copy of its
+	// data, or nil (optional). See HexdumpWriter.Tap and PcapngWriter.Tap
+	Tap func(a, b net.Conn) Tap
+}
+
+// Reason describes why a two-way copy ended.
+type Reason string
+
+// Reasons for a two-way copy to end.
+const (
+	// ReasonDone means that both directions reached EOF.
+	ReasonDone Reason = "done"
+	// ReasonError means that a direction failed.
+	ReasonError Reason = "error"
+	// ReasonCanceled means that the context was cancelled.
+	ReasonCanceled Reason = "canceled"
+	// ReasonIdleTimeout means that the idle timeout passed.
+	ReasonIdleTimeout Reason = "idle_timeout"
+	// ReasonMaxLifetime means that the maximum lifetime was reached.
+	ReasonMaxLifetime Reason = "max_lifetime"
+)
+
+// Result describes a finished two-way copy.
+//
+// BytesAtoB is the number of bytes read from a and written to b, and ErrAtoB the error that ended
+// this direction (nil if it ended with EOF); likewise for the other direction. Errors resulting from
+// Run closing the connections are not reported, except that directions interrupted by a cancelled
+// context, the idle timeout or the maximum lifetime report the context's error, ErrIdleTimeout or
+// ErrMaxLifetime, respectively.
+type Result struct {
+	BytesAtoB int64
+	BytesBtoA int64
+	ErrAtoB   error
+	ErrBtoA   error
+	Duration  time.Duration
+	Reason    Reason
+}
+
+// Errors of copy directions interrupted by the idle timeout or the maximum lifetime.
+var (
+	ErrIdleTimeout = errors.New("connpipe: idle timeout")
+	ErrMaxLifetime = errors.New("connpipe: maximum lifetime reached")
 )
 
-// Run starts a two-way copy between the two connections.
-func Run(ctx context.Context, a net.Conn, b net.Conn) {
-	var wg sync.WaitGroup
-	ctxAB, cancelAB := context.WithCancel(ctx)
-	copyAB := make(chan error)
-	go func() {
-		_, err := io.Copy(a, b)
-		copyAB <- err
-	}()
-	ctxBA, cancelBA := context.WithCancel(ctx)
-	copyBA := make(chan error)
-	go func() {
-		_, err := io.Copy(b, a)
-		copyBA <- err
-	}()
-	wg.Add(1)
-	go func() {
-		defer cancelBA()
-		defer wg.Done()
+// Run is Config{}.Run
+func Run(ctx context.Context, a net.Conn, b net.Conn) Result {
+	return Config{}.Run(ctx, a, b)
+}
+
+// Run starts a two-way copy between the two connections and waits until it has finished.
+//
+// When one direction reaches EOF, the writing side of its destination is shut down using CloseWrite
+// (as supported by *net.TCPConn, *net.UnixConn and ssh.Channel), and the other direction keeps running.
+// Destinations that do not support CloseWrite are closed instead.
+//
+// Both connections are closed after both directions have finished, after either direction has failed,
+// after the idle timeout has passed, after the maximum lifetime, or after the context has been cancelled.
+// Run returns only after both copying goroutines have exited.
+func (config Config) Run(ctx context.Context, a net.Conn, b net.Conn) Result {
+	start := time.Now()
+	limitCtx, cancelLimits := context.WithCancel(context.Background())
+	defer cancelLimits()
+	state := &pipeState{lastActive: start.UnixNano(), limitCtx: limitCtx}
+	if config.Tap != nil {
+		state.tap = config.Tap(a, b)
+	}
+	copyDone := make(chan copyResult, 2)
+	go func() { copyDone <- copyHalf(true, b, a, config.LimitAtoB, state) }()
+	go func() { copyDone <- copyHalf(false, a, b, config.LimitBtoA, state) }()
+
+	var closeOnce sync.Once
+	var closeErr error // the error for directions interrupted by closing the connections
+	reason := ReasonDone
+	closeBoth := func(why Reason, err error) {
+		closeOnce.Do(func() {
+			reason, closeErr = why, err
+			atomic.StoreInt32(&state.closed, 1)
+			cancelLimits()
+			a.Close()
+			b.Close()
+		})
+	}
+
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if config.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	var lifetime <-chan time.Time
+	if config.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(config.MaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+	var result Result
+	ctxDone := ctx.Done()
+	for running := 2; running > 0; {
 		select {
-		case <-ctxAB.Done():
-		case <-copyAB:
+		case done := <-copyDone:
+			running--
+			err := done.err
+			if err != nil {
+				if atomic.LoadInt32(&state.closed) != 0 {
+					err = closeErr
+				} else {
+					closeBoth(ReasonError, nil)
+				}
+			}
+			if done.aToB {
+				result.BytesAtoB, result.ErrAtoB = done.n, err
+			} else {
+				result.BytesBtoA, result.ErrBtoA = done.n, err
+			}
+		case <-ctxDone:
+			ctxDone = nil
+			closeBoth(ReasonCanceled, ctx.Err())
+		case <-idle:
+			idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&state.lastActive)))
+			if idleFor >= config.IdleTimeout {
+				idle = nil
+				closeBoth(ReasonIdleTimeout, ErrIdleTimeout)
+				continue
+			}
+			idleTimer.Reset(config.IdleTimeout - idleFor)
+		case <-lifetime:
+			lifetime = nil
+			closeBoth(ReasonMaxLifetime, ErrMaxLifetime)
 		}
-	}()
-	wg.Add(1)
-	go func() {
-		defer cancelAB()
-		defer wg.Done()
-		select {
-		case <-ctxBA.Done():
-		case <-copyBA:
+	}
+	closeBoth(reason, nil)
+	if state.tap != nil {
+		state.tap.Close()
+	}
+	result.Duration = time.Since(start)
+	result.Reason = reason
+	return result
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipeState is shared between the copying goroutines of a pipe.
+type pipeState struct {
+	lastActive int64           // UnixNano time of the last transfer
+	closed     int32           // set before the pipe closes any of its connections
+	limitCtx   context.Context // cancelled when the pipe closes its connections
+	tap        Tap
+}
+
+type copyResult struct {
+	aToB bool
+	n    int64
+	err  error
+}
+
+// copyHalf copies from src to dst until EOF or an error, recording the time of the last transfer and
+// waiting for the rate limits before each write.
+// On EOF, it shuts down the writing side of dst (or closes dst if that is not supported).
+func copyHalf(aToB bool, dst, src net.Conn, limits []*tokenbucket.Bucket, state *pipeState) copyResult {
+	result := copyResult{aToB: aToB}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf[:chunkSize(len(buf), limits)])
+		if n > 0 {
+			atomic.StoreInt64(&state.lastActive, time.Now().UnixNano())
+			for _, limit := range limits {
+				if errWait := limit.WaitN(state.limitCtx, n); errWait != nil {
+					result.err = net.ErrClosed
+					return result
+				}
+			}
+			written, errWrite := dst.Write(buf[:n])
+			result.n += int64(written)
+			if state.tap != nil && written > 0 {
+				state.tap.Data(aToB, buf[:written])
+			}
+			atomic.StoreInt64(&state.lastActive, time.Now().UnixNano())
+			if errWrite != nil {
+				result.err = errWrite
+				return result
+			}
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(closeWriter); !ok || cw.CloseWrite() != nil {
+				atomic.StoreInt32(&state.closed, 1)
+				dst.Close()
+			}
+			return result
+		}
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+}
+
+// chunkSize returns the size of the next chunk to copy, at most the burst size of the rate-limited buckets.
+func chunkSize(size int, limits []*tokenbucket.Bucket) int {
+	for _, limit := range limits {
+		if rate, burst := limit.Rate(); rate > 0 && burst < size {
+			size = burst
 		}
-	}()
-	wg.Wait()
+	}
+	return size
 }
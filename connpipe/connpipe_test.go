@@ -0,0 +1,334 @@
+package connpipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sgreben/sshtunnel/tokenbucket"
+)
+
+func TestRunCancelWhileBlocked(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	defer aPeer.Close()
+	defer bPeer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan Result)
+	go func() { done <- Run(ctx, a, b) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	var result Result
+	select {
+	case result = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if result.Reason != ReasonCanceled {
+		t.Errorf("Reason = %q, want %q", result.Reason, ReasonCanceled)
+	}
+	if result.ErrAtoB != context.Canceled || result.ErrBtoA != context.Canceled {
+		t.Errorf("errors = %v, %v, want %v", result.ErrAtoB, result.ErrBtoA, context.Canceled)
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines, want %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunResult(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	go func() {
+		bPeer.Write([]byte("world!"))
+		io.Copy(io.Discard, bPeer)
+		bPeer.Close()
+	}()
+	go func() {
+		io.ReadFull(aPeer, make([]byte, 6))
+		aPeer.Write([]byte("hello"))
+		aPeer.Close()
+	}()
+	result := Run(context.Background(), a, b)
+	if result.Reason != ReasonDone {
+		t.Errorf("Reason = %q, want %q", result.Reason, ReasonDone)
+	}
+	if result.BytesAtoB != 5 || result.BytesBtoA != 6 {
+		t.Errorf("bytes = %d, %d, want 5, 6", result.BytesAtoB, result.BytesBtoA)
+	}
+	if result.ErrAtoB != nil || result.ErrBtoA != nil {
+		t.Errorf("errors = %v, %v, want nil", result.ErrAtoB, result.ErrBtoA)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type failWriteConn struct{ net.Conn }
+
+func (c failWriteConn) Write(p []byte) (int, error) { return 0, errWrite }
+
+func TestRunResultError(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	defer bPeer.Close()
+	go aPeer.Write([]byte("hello"))
+	result := Run(context.Background(), a, failWriteConn{b})
+	if result.Reason != ReasonError {
+		t.Errorf("Reason = %q, want %q", result.Reason, ReasonError)
+	}
+	if result.ErrAtoB != errWrite || result.ErrBtoA != nil {
+		t.Errorf("errors = %v, %v, want %v, nil", result.ErrAtoB, result.ErrBtoA, errWrite)
+	}
+}
+
+func TestRunIdleTimeout(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	defer aPeer.Close()
+	defer bPeer.Close()
+	go io.Copy(io.Discard, bPeer)
+	go func() {
+		// Keep the pipe active for a while; the timeout counts from the last transfer.
+		for i := 0; i < 6; i++ {
+			if _, err := aPeer.Write([]byte{byte(i)}); err != nil {
+				return
+			}
+			time.Sleep(25 * time.Millisecond)
+		}
+	}()
+	result := Config{IdleTimeout: 100 * time.Millisecond}.Run(context.Background(), a, b)
+	if result.Reason != ReasonIdleTimeout {
+		t.Errorf("Reason = %q, want %q", result.Reason, ReasonIdleTimeout)
+	}
+	if result.ErrAtoB != ErrIdleTimeout || result.ErrBtoA != ErrIdleTimeout {
+		t.Errorf("errors = %v, %v, want %v", result.ErrAtoB, result.ErrBtoA, ErrIdleTimeout)
+	}
+	if result.BytesAtoB != 6 {
+		t.Errorf("BytesAtoB = %d, want 6", result.BytesAtoB)
+	}
+	if result.Duration < 200*time.Millisecond || result.Duration > time.Second {
+		t.Errorf("Duration = %v, want about 225ms", result.Duration)
+	}
+}
+
+func TestRunMaxLifetime(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	defer aPeer.Close()
+	defer bPeer.Close()
+	go io.Copy(io.Discard, bPeer)
+	go func() {
+		for {
+			if _, err := aPeer.Write([]byte("active")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	config := Config{IdleTimeout: 50 * time.Millisecond, MaxLifetime: 100 * time.Millisecond}
+	result := config.Run(context.Background(), a, b)
+	if result.Reason != ReasonMaxLifetime {
+		t.Errorf("Reason = %q, want %q", result.Reason, ReasonMaxLifetime)
+	}
+	if result.ErrAtoB != ErrMaxLifetime || result.ErrBtoA != ErrMaxLifetime {
+		t.Errorf("errors = %v, %v, want %v", result.ErrAtoB, result.ErrBtoA, ErrMaxLifetime)
+	}
+	if result.Duration < 100*time.Millisecond || result.Duration > time.Second {
+		t.Errorf("Duration = %v, want about 100ms", result.Duration)
+	}
+}
+
+func TestRunHalfCloseTCP(t *testing.T) {
+	a, aPeer := tcpPair(t)
+	b, bPeer := tcpPair(t)
+	done := make(chan Result)
+	go func() { done <- Run(context.Background(), a, b) }()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		request, err := io.ReadAll(bPeer)
+		if err == nil && string(request) != "request" {
+			err = errors.New("unexpected request " + string(request))
+		}
+		if err == nil {
+			_, err = bPeer.Write([]byte("response"))
+		}
+		bPeer.Close()
+		serverErr <- err
+	}()
+	if _, err := aPeer.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := aPeer.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(aPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "response" {
+		t.Errorf("response = %q, want %q", response, "response")
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	result := <-done
+	if result.Reason != ReasonDone || result.BytesAtoB != 7 || result.BytesBtoA != 8 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+func TestChunkSize(t *testing.T) {
+	tests := []struct {
+		limits []*tokenbucket.Bucket
+		want   int
+	}{
+		{nil, 1024},
+		{[]*tokenbucket.Bucket{tokenbucket.New(0, 10)}, 1024},
+		{[]*tokenbucket.Bucket{tokenbucket.New(100, 10)}, 10},
+		{[]*tokenbucket.Bucket{tokenbucket.New(100, 4096)}, 1024},
+		{[]*tokenbucket.Bucket{tokenbucket.New(100, 50), tokenbucket.New(0, 10), tokenbucket.New(100, 20)}, 20},
+	}
+	for i, test := range tests {
+		if got := chunkSize(1024, test.limits); got != test.want {
+			t.Errorf("%d: chunkSize = %d, want %d", i, got, test.want)
+		}
+	}
+}
+
+// readChunks reads from conn until EOF or an error and sends the total number of bytes and the size of
+// the largest read on the returned channel.
+func readChunks(conn net.Conn) <-chan [2]int {
+	done := make(chan [2]int, 1)
+	go func() {
+		var total, largest int
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buf)
+			total += n
+			if n > largest {
+				largest = n
+			}
+			if err != nil {
+				done <- [2]int{total, largest}
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func TestRunRateLimit(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	received := readChunks(bPeer)
+	go func() {
+		aPeer.Write(make([]byte, 3000))
+		aPeer.Close()
+	}()
+	config := Config{LimitAtoB: []*tokenbucket.Bucket{tokenbucket.New(10000, 1000)}}
+	result := config.Run(context.Background(), a, b)
+	if result.BytesAtoB != 3000 {
+		t.Errorf("BytesAtoB = %d, want 3000", result.BytesAtoB)
+	}
+	// The first 1000 bytes are the burst, the remaining 2000 take 200ms.
+	if result.Duration < 150*time.Millisecond {
+		t.Errorf("Duration = %v, want at least 200ms", result.Duration)
+	}
+	if r := <-received; r[0] != 3000 || r[1] > 1000 {
+		t.Errorf("received %d bytes in chunks of up to %d, want 3000 in chunks of up to 1000", r[0], r[1])
+	}
+}
+
+func TestRunSetRateLive(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	received := readChunks(bPeer)
+	go func() {
+		aPeer.Write(make([]byte, 100000))
+		aPeer.Close()
+	}()
+	limit := tokenbucket.New(100, 10) // 1000 seconds for all of the data
+	done := make(chan Result)
+	go func() { done <- Config{LimitAtoB: []*tokenbucket.Bucket{limit}}.Run(context.Background(), a, b) }()
+	time.Sleep(50 * time.Millisecond)
+	limit.SetRate(0, 0)
+	select {
+	case result := <-done:
+		if result.BytesAtoB != 100000 {
+			t.Errorf("BytesAtoB = %d, want 100000", result.BytesAtoB)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not speed up after the limit was removed")
+	}
+	if r := <-received; r[0] != 100000 || r[1] <= 10 {
+		t.Errorf("received %d bytes in chunks of up to %d, want 100000 in chunks larger than 10", r[0], r[1])
+	}
+}
+
+func TestRunCancelRefundsLimit(t *testing.T) {
+	// Two pipes share a limit; cancelling one while it waits must not slow down the other.
+	limit := tokenbucket.New(1000, 1000)
+	config := Config{LimitAtoB: []*tokenbucket.Bucket{limit}}
+
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	defer aPeer.Close()
+	go io.Copy(io.Discard, bPeer)
+	go aPeer.Write(make([]byte, 2000)) // the second 1000 bytes wait for a second
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan Result)
+	go func() { done <- config.Run(ctx, a, b) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if result := <-done; result.Reason != ReasonCanceled || result.BytesAtoB != 1000 {
+		t.Fatalf("result = %+v, want 1000 bytes and reason %q", result, ReasonCanceled)
+	}
+
+	a, aPeer = net.Pipe()
+	b, bPeer = net.Pipe()
+	received := readChunks(bPeer)
+	go func() {
+		aPeer.Write(make([]byte, 100))
+		aPeer.Close()
+	}()
+	result := config.Run(context.Background(), a, b)
+	if result.BytesAtoB != 100 || result.Duration > 500*time.Millisecond {
+		t.Errorf("result = %+v, want 100 bytes within 500ms", result)
+	}
+	<-received
+}
@@ -0,0 +1,233 @@
+package connpipe
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngBlockSectionHeader        = 0x0A0D0D0A
+	pcapngBlockInterfaceDescription = 0x00000001
+	pcapngBlockEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic            = 0x1A2B3C4D
+	pcapngLinkTypeRaw               = 101 // raw IPv4/IPv6 packets
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	pcapngMaxSegment = 32 * 1024
+)
+
+// PcapngWriter writes the data of tapped two-way copies as a pcap-ng capture of synthesized TCP connections,
+// which can be inspected using e.g. Wireshark. Each two-way copy between a and b is shown as a TCP connection
+// from the remote address of b (the client) to the remote address of a (the server); addresses that are not
+// (specified) IP addresses are replaced by loopback addresses. Write errors are ignored.
+type PcapngWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	sessions int
+}
+
+// NewPcapngWriter returns a PcapngWriter writing to w, after writing the capture file header.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	var header []byte
+	// Section Header Block: byte order magic, version 1.0, unspecified section length.
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+	header = appendPcapngBlock(header, pcapngBlockSectionHeader, shb)
+	// Interface Description Block: raw IP link type, no snapshot length limit, microsecond timestamps.
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+	header = appendPcapngBlock(header, pcapngBlockInterfaceDescription, idb)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapngWriter{w: w}, nil
+}
+
+// Tap returns a Tap for a two-way copy between a and b. It can be used as Config.Tap.
+// It writes the synthesized TCP handshake immediately.
+func (w *PcapngWriter) Tap(a, b net.Conn) Tap {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sessions++
+	t := &pcapngTap{writer: w}
+	t.server, t.client = pcapngEndpoints(a.RemoteAddr(), b.RemoteAddr(), w.sessions)
+	t.write(false, tcpFlagSYN, nil)
+	t.clientSeq++
+	t.write(true, tcpFlagSYN|tcpFlagACK, nil)
+	t.serverSeq++
+	t.write(false, tcpFlagACK, nil)
+	return t
+}
+
+type pcapngTap struct {
+	writer               *PcapngWriter
+	server, client       net.TCPAddr
+	serverSeq, clientSeq uint32
+}
+
+func (t *pcapngTap) Data(aToB bool, p []byte) {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+	for len(p) > 0 {
+		n := len(p)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+		t.write(aToB, tcpFlagPSH|tcpFlagACK, p[:n])
+		if aToB {
+			t.serverSeq += uint32(n)
+		} else {
+			t.clientSeq += uint32(n)
+		}
+		p = p[n:]
+	}
+}
+
+func (t *pcapngTap) Close() error {
+	t.writer.mu.Lock()
+	defer t.writer.mu.Unlock()
+	t.write(false, tcpFlagFIN|tcpFlagACK, nil)
+	t.clientSeq++
+	t.write(true, tcpFlagFIN|tcpFlagACK, nil)
+	t.serverSeq++
+	t.write(false, tcpFlagACK, nil)
+	return nil
+}
+
+// write writes a TCP segment sent by the server (fromServer) or the client. The caller must hold t.writer.mu.
+func (t *pcapngTap) write(fromServer bool, flags byte, payload []byte) {
+	src, dst := t.client, t.server
+	seq, ack := t.clientSeq, t.serverSeq
+	if fromServer {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+	packet := ipPacket(src, dst, tcpSegment(src, dst, seq, ack, flags, payload))
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	epb := make([]byte, 20, 20+len(packet)+3)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface ID
+	binary.LittleEndian.PutUint32(epb[4:], uint32(uint64(now)>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(now))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(packet)))
+	epb = append(epb, packet...)
+	for len(epb)%4 != 0 {
+		epb = append(epb, 0)
+	}
+	t.writer.w.Write(appendPcapngBlock(nil, pcapngBlockEnhancedPacket, epb))
+}
+
+// pcapngEndpoints returns the TCP endpoints shown for the server and client addresses.
+// Addresses that are not specified IP addresses of the same family are replaced by IPv4 loopback addresses.
+func pcapngEndpoints(server, client net.Addr, session int) (net.TCPAddr, net.TCPAddr) {
+	serverTCP, serverOK := server.(*net.TCPAddr)
+	clientTCP, clientOK := client.(*net.TCPAddr)
+	serverOK = serverOK && serverTCP.IP != nil && !serverTCP.IP.IsUnspecified()
+	clientOK = clientOK && clientTCP.IP != nil && !clientTCP.IP.IsUnspecified()
+	if serverOK && clientOK && (serverTCP.IP.To4() == nil) == (clientTCP.IP.To4() == nil) {
+		return *serverTCP, *clientTCP
+	}
+	serverOut := net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}
+	if serverOK && serverTCP.IP.To4() != nil {
+		serverOut = *serverTCP
+	}
+	clientOut := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1024 + session%64000}
+	if clientOK && clientTCP.IP.To4() != nil {
+		clientOut = *clientTCP
+	}
+	return serverOut, clientOut
+}
+
+func tcpSegment(src, dst net.TCPAddr, seq, ack uint32, flags byte, payload []byte) []byte {
+	segment := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(segment[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(segment[4:], seq)
+	binary.BigEndian.PutUint32(segment[8:], ack)
+	segment[12] = 5 << 4 // data offset: 5 words
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 0xFFFF) // window
+	segment = append(segment, payload...)
+	var pseudo []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		pseudo = append(append(pseudo, src4...), dst4...)
+		pseudo = append(pseudo, 0, 6, byte(len(segment)>>8), byte(len(segment)))
+	} else {
+		pseudo = append(append(pseudo, src.IP.To16()...), dst.IP.To16()...)
+		pseudo = append(pseudo, byte(len(segment)>>24), byte(len(segment)>>16), byte(len(segment)>>8), byte(len(segment)), 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(segment[16:], checksum(pseudo, segment))
+	return segment
+}
+
+func ipPacket(src, dst net.TCPAddr, segment []byte) []byte {
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		header := make([]byte, 20, 20+len(segment))
+		header[0] = 0x45 // version 4, header length 5 words
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+		binary.BigEndian.PutUint16(header[6:], 0x4000) // don't fragment
+		header[8] = 64                                 // TTL
+		header[9] = 6                                  // TCP
+		copy(header[12:16], src4)
+		copy(header[16:20], dst4)
+		binary.BigEndian.PutUint16(header[10:], checksum(header))
+		return append(header, segment...)
+	}
+	header := make([]byte, 40, 40+len(segment))
+	header[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+	header[6] = 6  // TCP
+	header[7] = 64 // hop limit
+	copy(header[8:24], src.IP.To16())
+	copy(header[24:40], dst.IP.To16())
+	return append(header, segment...)
+}
+
+// checksum returns the Internet checksum (RFC 1071) of the concatenated data.
+func checksum(data ...[]byte) uint16 {
+	var sum uint32
+	var odd bool
+	var last byte
+	for _, d := range data {
+		for _, b := range d {
+			if odd {
+				sum += uint32(last)<<8 | uint32(b)
+			} else {
+				last = b
+			}
+			odd = !odd
+		}
+	}
+	if odd {
+		sum += uint32(last) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// appendPcapngBlock appends a pcap-ng block with the given type and (4-byte aligned) body to out.
+func appendPcapngBlock(out []byte, blockType uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	var word [4]byte
+	binary.LittleEndian.PutUint32(word[:], blockType)
+	out = append(out, word[:]...)
+	binary.LittleEndian.PutUint32(word[:], length)
+	out = append(out, word[:]...)
+	out = append(out, body...)
+	return append(out, word[:]...)
+}
@@ -0,0 +1,238 @@
+package connpipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	// The example from RFC 1071, section 3.
+	data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got := checksum(data); got != ^uint16(0xddf2) {
+		t.Errorf("checksum = %#04x, want %#04x", got, ^uint16(0xddf2))
+	}
+	// Odd-length slices are summed as if concatenated.
+	if got := checksum(data[:1], data[1:4], data[4:]); got != ^uint16(0xddf2) {
+		t.Errorf("checksum of split data = %#04x, want %#04x", got, ^uint16(0xddf2))
+	}
+	// An odd total length is padded with a zero byte.
+	if got, want := checksum([]byte{0x01, 0x02, 0x03}), ^uint16(0x0102+0x0300); got != want {
+		t.Errorf("checksum of odd-length data = %#04x, want %#04x", got, want)
+	}
+}
+
+// addrConn is a net.Conn with the given remote address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// pcapngSegment is a TCP segment read back from a capture.
+type pcapngSegment struct {
+	src, dst net.TCPAddr
+	seq, ack uint32
+	flags    byte
+	payload  string
+}
+
+// readPcapng parses a capture written by a PcapngWriter, checking the block framing and the IP and TCP checksums.
+func readPcapng(t *testing.T, data []byte) []pcapngSegment {
+	var segments []pcapngSegment
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < 12 {
+			t.Fatalf("block %d: truncated", i)
+		}
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("block %d: bad length %d", i, length)
+		}
+		body := data[8 : length-4]
+		data = data[length:]
+		switch {
+		case i == 0:
+			if blockType != pcapngBlockSectionHeader || binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				t.Fatalf("block %d: not a section header", i)
+			}
+		case i == 1:
+			if blockType != pcapngBlockInterfaceDescription || binary.LittleEndian.Uint16(body) != pcapngLinkTypeRaw {
+				t.Fatalf("block %d: not a raw IP interface description", i)
+			}
+		default:
+			if blockType != pcapngBlockEnhancedPacket {
+				t.Fatalf("block %d: type %#x, want an enhanced packet", i, blockType)
+			}
+			captured := binary.LittleEndian.Uint32(body[12:])
+			if binary.LittleEndian.Uint32(body[16:]) != captured {
+				t.Fatalf("block %d: truncated packet", i)
+			}
+			segments = append(segments, parsePacket(t, body[20:20+captured]))
+		}
+	}
+	return segments
+}
+
+func parsePacket(t *testing.T, packet []byte) pcapngSegment {
+	var s pcapngSegment
+	var segment, pseudo []byte
+	switch packet[0] >> 4 {
+	case 4:
+		header := packet[:20]
+		if checksum(header) != 0 {
+			t.Fatalf("bad IPv4 header checksum: % x", header)
+		}
+		if int(binary.BigEndian.Uint16(header[2:])) != len(packet) || header[9] != 6 {
+			t.Fatalf("bad IPv4 header: % x", header)
+		}
+		s.src.IP, s.dst.IP = net.IP(header[12:16]), net.IP(header[16:20])
+		segment = packet[20:]
+		pseudo = append(append(pseudo, header[12:20]...), 0, 6, byte(len(segment)>>8), byte(len(segment)))
+	case 6:
+		header := packet[:40]
+		if int(binary.BigEndian.Uint16(header[4:])) != len(packet)-40 || header[6] != 6 {
+			t.Fatalf("bad IPv6 header: % x", header)
+		}
+		s.src.IP, s.dst.IP = net.IP(header[8:24]), net.IP(header[24:40])
+		segment = packet[40:]
+		pseudo = append(append(pseudo, header[8:40]...), 0, 0, byte(len(segment)>>8), byte(len(segment)), 0, 0, 0, 6)
+	default:
+		t.Fatalf("bad IP version: % x", packet)
+	}
+	if checksum(pseudo, segment) != 0 {
+		t.Fatalf("bad TCP checksum: % x", segment)
+	}
+	s.src.Port = int(binary.BigEndian.Uint16(segment[0:]))
+	s.dst.Port = int(binary.BigEndian.Uint16(segment[2:]))
+	s.seq = binary.BigEndian.Uint32(segment[4:])
+	s.ack = binary.BigEndian.Uint32(segment[8:])
+	s.flags = segment[13]
+	s.payload = string(segment[20:])
+	return s
+}
+
+func TestPcapngWriter(t *testing.T) {
+	tests := map[string]struct {
+		server, client *net.TCPAddr
+	}{
+		"ipv4": {
+			server: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80},
+			client: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000},
+		},
+		"ipv6": {
+			server: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			client: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50001},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			w, err := NewPcapngWriter(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tap := w.Tap(addrConn{addr: test.server}, addrConn{addr: test.client})
+			tap.Data(true, []byte("hello"))
+			tap.Data(false, []byte("hi"))
+			tap.Close()
+
+			const (
+				syn = tcpFlagSYN
+				ack = tcpFlagACK
+				psh = tcpFlagPSH | tcpFlagACK
+				fin = tcpFlagFIN | tcpFlagACK
+			)
+			want := []struct {
+				fromServer bool
+				seq, ack   uint32
+				flags      byte
+				payload    string
+			}{
+				{false, 0, 0, syn, ""},
+				{true, 0, 1, syn | ack, ""},
+				{false, 1, 1, ack, ""},
+				{true, 1, 1, psh, "hello"},
+				{false, 1, 6, psh, "hi"},
+				{false, 3, 6, fin, ""},
+				{true, 6, 4, fin, ""},
+				{false, 4, 7, ack, ""},
+			}
+			segments := readPcapng(t, out.Bytes())
+			if len(segments) != len(want) {
+				t.Fatalf("%d segments, want %d", len(segments), len(want))
+			}
+			for i, s := range segments {
+				exp := want[i]
+				src, dst := test.client, test.server
+				if exp.fromServer {
+					src, dst = dst, src
+				}
+				if s.src.String() != src.String() || s.dst.String() != dst.String() {
+					t.Errorf("segment %d: %v > %v, want %v > %v", i, &s.src, &s.dst, src, dst)
+				}
+				if s.seq != exp.seq || s.ack != exp.ack || s.flags != exp.flags || s.payload != exp.payload {
+					t.Errorf("segment %d: seq %d ack %d flags %#x payload %q, want seq %d ack %d flags %#x payload %q",
+						i, s.seq, s.ack, s.flags, s.payload, exp.seq, exp.ack, exp.flags, exp.payload)
+				}
+			}
+		})
+	}
+}
+
+func TestPcapngWriterSegments(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewPcapngWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := w.Tap(addrConn{addr: &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}}, addrConn{addr: &net.UnixAddr{Net: "unix"}})
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*pcapngMaxSegment+100)/16)
+	tap.Data(true, data)
+	segments := readPcapng(t, out.Bytes())[3:]
+	var sizes []int
+	var received []byte
+	seq := uint32(1)
+	for _, s := range segments {
+		if s.seq != seq {
+			t.Errorf("seq = %d, want %d", s.seq, seq)
+		}
+		seq += uint32(len(s.payload))
+		sizes = append(sizes, len(s.payload))
+		received = append(received, s.payload...)
+	}
+	if len(sizes) != 3 || sizes[0] != pcapngMaxSegment || sizes[1] != pcapngMaxSegment {
+		t.Errorf("segment sizes %v, want %d, %d, rest", sizes, pcapngMaxSegment, pcapngMaxSegment)
+	}
+	if !bytes.Equal(received, data) {
+		t.Error("segment payloads differ from the data")
+	}
+}
+
+func TestPcapngEndpoints(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50000}
+	unix := &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}
+	unspecified := &net.TCPAddr{IP: net.IPv4zero, Port: 8080}
+	tests := []struct {
+		server, client net.Addr
+		session        int
+		want           [2]string
+	}{
+		{v4, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}, 1, [2]string{"10.0.0.1:80", "10.0.0.2:50000"}},
+		{v6, v6, 1, [2]string{"[2001:db8::2]:50000", "[2001:db8::2]:50000"}},
+		{unix, unix, 7, [2]string{"127.0.0.2:1", "127.0.0.1:1031"}},
+		{v4, unix, 1, [2]string{"10.0.0.1:80", "127.0.0.1:1025"}},
+		{v4, v6, 1, [2]string{"10.0.0.1:80", "127.0.0.1:1025"}},
+		{v6, v4, 1, [2]string{"127.0.0.2:1", "10.0.0.1:80"}},
+		{unspecified, v4, 1, [2]string{"127.0.0.2:1", "10.0.0.1:80"}},
+	}
+	for i, test := range tests {
+		server, client := pcapngEndpoints(test.server, test.client, test.session)
+		if got := [2]string{server.String(), client.String()}; got != test.want {
+			t.Errorf("%d: pcapngEndpoints(%v, %v) = %v, want %v", i, test.server, test.client, got, test.want)
+		}
+	}
+}
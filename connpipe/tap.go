@@ -0,0 +1,64 @@
+package connpipe
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tap receives a copy of the data transferred by a two-way copy (see Config.Tap).
+// Data is called concurrently by the goroutines of both directions.
+type Tap interface {
+	// Data is called with each chunk of data after it has been copied from a to b (aToB) or from b to a.
+	Data(aToB bool, p []byte)
+	// Close is called after the two-way copy has finished.
+	Close() error
+}
+
+// HexdumpWriter writes the data of tapped two-way copies as timestamped hexdumps.
+// Write errors are ignored.
+type HexdumpWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewHexdumpWriter returns a HexdumpWriter writing to w.
+func NewHexdumpWriter(w io.Writer) *HexdumpWriter {
+	return &HexdumpWriter{w: w}
+}
+
+// Tap returns a Tap for a two-way copy between a and b. It can be used as Config.Tap.
+func (w *HexdumpWriter) Tap(a, b net.Conn) Tap {
+	return &hexdumpTap{writer: w, a: a.RemoteAddr(), b: b.RemoteAddr()}
+}
+
+func (w *HexdumpWriter) write(format string, args ...interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.w, format, args...)
+}
+
+type hexdumpTap struct {
+	writer *HexdumpWriter
+	a, b   net.Addr
+}
+
+func (t *hexdumpTap) Data(aToB bool, p []byte) {
+	src, dst := t.a, t.b
+	if !aToB {
+		src, dst = dst, src
+	}
+	t.writer.write("%s %s > %s (%d bytes)\n%s", timestamp(), src, dst, len(p), hex.Dump(p))
+}
+
+func (t *hexdumpTap) Close() error {
+	t.writer.write("%s %s <> %s closed\n", timestamp(), t.a, t.b)
+	return nil
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05.000000Z")
+}
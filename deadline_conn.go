@@ -0,0 +1,258 @@
+package sshtunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadlineConn adds read and write deadline support to a net.Conn that does not support deadlines itself
+// (such as the channel connections returned by ssh.Client.Dial).
+//
+// Reads and writes are performed by background goroutines, so that blocked calls can return
+// with os.ErrDeadlineExceeded when their deadline expires. A write that has already started when its
+// deadline expires cannot be abandoned, since it still uses the caller's buffer: the connection is
+// closed to interrupt it, and is unusable afterwards.
+type deadlineConn struct {
+	net.Conn
+	readDeadline  deadline
+	writeDeadline deadline
+
+	readMu      sync.Mutex
+	readOnce    sync.Once
+	reads       chan deadlineConnRead
+	readBufs    chan []byte // read buffers not in use
+	readBuf     []byte      // the read buffer holding readPending
+	readPending []byte
+	readErr     error
+
+	writeOnce sync.Once
+	writes    chan deadlineConnWrite
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type deadlineConnRead struct {
+	buf []byte
+	p   []byte
+	err error
+}
+
+type deadlineConnWrite struct {
+	p          []byte
+	closeWrite bool
+	done       chan deadlineConnWritten
+}
+
+type deadlineConnWritten struct {
+	n   int
+	err error
+}
+
+func newDeadlineConn(conn net.Conn) *deadlineConn {
+	return &deadlineConn{
+		Conn:          conn,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		reads:         make(chan deadlineConnRead),
+		readBufs:      make(chan []byte, 1),
+		writes:        make(chan deadlineConnWrite),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if isClosedChan(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(c.readPending) == 0 && c.readErr == nil {
+		c.readOnce.Do(func() {
+			c.readBufs <- make([]byte, 32*1024)
+			go c.readLoop()
+		})
+		select {
+		case r := <-c.reads:
+			c.readBuf, c.readPending, c.readErr = r.buf, r.p, r.err
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(p, c.readPending)
+	c.readPending = c.readPending[n:]
+	if len(c.readPending) == 0 && c.readErr != nil {
+		return n, c.readErr
+	}
+	if len(c.readPending) == 0 {
+		c.readBufs <- c.readBuf
+	}
+	return n, nil
+}
+
+func (c *deadlineConn) readLoop() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-c.readBufs:
+		case <-c.closed:
+			return
+		}
+		n, err := c.Conn.Read(buf)
+		select {
+		case c.reads <- deadlineConnRead{buf: buf, p: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	return c.write(deadlineConnWrite{p: p})
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if it supports it,
+// after all pending writes have completed.
+func (c *deadlineConn) CloseWrite() error {
+	if _, ok := c.Conn.(interface{ CloseWrite() error }); !ok {
+		return errors.New("ssh: deadlineConn: CloseWrite not supported")
+	}
+	_, err := c.write(deadlineConnWrite{closeWrite: true})
+	return err
+}
+
+func (c *deadlineConn) write(req deadlineConnWrite) (int, error) {
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.writeOnce.Do(func() { go c.writeLoop() })
+	req.done = make(chan deadlineConnWritten, 1)
+	select {
+	case c.writes <- req:
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+	// The write has started: wait for it to return, closing the connection to interrupt it
+	// if the deadline expires.
+	select {
+	case w := <-req.done:
+		return w.n, w.err
+	case <-c.writeDeadline.wait():
+		c.Close()
+		w := <-req.done
+		return w.n, os.ErrDeadlineExceeded
+	case <-c.closed:
+		w := <-req.done
+		if w.err == nil {
+			return w.n, nil
+		}
+		return w.n, net.ErrClosed
+	}
+}
+
+func (c *deadlineConn) writeLoop() {
+	for {
+		select {
+		case req := <-c.writes:
+			var w deadlineConnWritten
+			if req.closeWrite {
+				w.err = c.Conn.(interface{ CloseWrite() error }).CloseWrite()
+			} else {
+				w.n, w.err = c.Conn.Write(req.p)
+			}
+			req.done <- w
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *deadlineConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a resettable deadline whose wait channel is closed once it expires.
+type deadline struct {
+	mu     *sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{mu: &sync.Mutex{}, cancel: make(chan struct{})}
+}
+
+// set sets the deadline. The zero time clears it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish
+	}
+	d.timer = nil
+	expired := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
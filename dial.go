@@ -2,9 +2,13 @@ package sshtunnel
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // DialFunc is a dialler for tunneled connections.
@@ -20,27 +24,19 @@ func Dial(network, addr string, config *Config) (net.Conn, <-chan error, error)
 // DialContext opens a tunnelled connection to the address on the named network using
 // the provided context.
 //
+// The returned connection supports read and write deadlines.
+//
 // See func Dial for a description of the network and address parameters.
 func DialContext(ctx context.Context, network, addr string, config *Config) (net.Conn, <-chan error, error) {
 	if ctx == nil {
 		panic("nil context")
 	}
-	sshAddr := withDefaultPort(config.SSHAddr, "22")
-	sshConfig := config.SSHClient
-	connectSSH := func(ctx context.Context) (*ssh.Client, chan error, error) {
-		return dialSSH(ctx, sshAddr, sshConfig)
-	}
-	if config.SSHConn != nil {
-		connectSSH = func(ctx context.Context) (*ssh.Client, chan error, error) {
-			return dialConnSSH(ctx, config.SSHConn, sshAddr, sshConfig)
-		}
-	}
 	select {
 	case <-ctx.Done():
 		return nil, nil, ctx.Err()
 	default:
 	}
-	client, wait, err := connectSSH(ctx)
+	client, wait, err := connectSSH(ctx, config)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -49,42 +45,207 @@ func DialContext(ctx context.Context, network, addr string, config *Config) (net
 		return nil, nil, ctx.Err()
 	default:
 	}
-	conn, err := client.Dial(network, addr)
+	start := time.Now()
+	conn, err := dialChannel(ctx, client, network, addr)
 	if err != nil {
+		client.Close()
 		return nil, nil, err
 	}
-	return conn, wait, nil
+	return newDeadlineConn(observeConn(conn, config.Observer, network, addr, start)), wait, nil
 }
 
-func dialConnSSH(ctx context.Context, conn net.Conn, sshAddr string, sshConfig *ssh.ClientConfig) (*ssh.Client, chan error, error) {
-	c, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, sshConfig)
-	if err != nil {
-		return nil, nil, err
+// connectSSH opens an SSH client connection as configured, going through the configured jump hosts (if any).
+// The client (and the jump host clients) are closed when the context is cancelled, also while connecting.
+func connectSSH(ctx context.Context, config *Config) (*ssh.Client, chan error, error) {
+	if config.KeepAlive != nil && config.KeepAlive.Interval <= 0 {
+		return nil, nil, fmt.Errorf("keepalive: interval must be positive, got %v", config.KeepAlive.Interval)
 	}
-	client := ssh.NewClient(c, chans, reqs)
-	wait := make(chan error)
+	hops := append(append([]JumpHost(nil), config.Jumps...), JumpHost{
+		Addr:      config.SSHAddr,
+		SSHClient: config.SSHClient,
+	})
+	chain := &sshChain{}
+	done := make(chan struct{})
 	go func() {
-		wait <- client.Wait()
+		select {
+		case <-ctx.Done():
+			chain.close()
+		case <-done:
+		}
 	}()
+	fail := func(err error) (*ssh.Client, chan error, error) {
+		close(done)
+		chain.close()
+		return nil, nil, err
+	}
+	var client *ssh.Client
+	for i, hop := range hops {
+		var err error
+		client, err = dialHop(ctx, config, hop, client, chain.dialing)
+		if err == nil {
+			err = chain.add(client)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if len(hops) > 1 {
+				return fail(hopError(i, len(hops), hop, err))
+			}
+			return fail(err)
+		}
+	}
+	if config.ForwardAgent != nil {
+		if err := agent.ForwardToAgent(client, config.ForwardAgent); err != nil {
+			return fail(fmt.Errorf("forward agent: %v", err))
+		}
+	}
+	var keepAliveErr chan error
+	if config.KeepAlive != nil {
+		keepAliveErr = make(chan error, 1)
+		go func() {
+			keepAliveErr <- config.KeepAlive.run(client, done)
+		}()
+	}
+	wait := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		client.Close()
+		err := client.Wait()
+		close(done)
+		chain.close()
+		if keepAliveErr != nil {
+			if errKeepAlive := <-keepAliveErr; errKeepAlive != nil {
+				err = errKeepAlive
+			}
+		}
+		observe(config.Observer, EventSSHDisconnected{Addr: config.SSHAddr, Err: err})
+		wait <- err
 	}()
 	return client, wait, nil
 }
 
-func dialSSH(ctx context.Context, sshAddr string, sshConfig *ssh.ClientConfig) (*ssh.Client, chan error, error) {
-	client, err := ssh.Dial("tcp", sshAddr, sshConfig)
-	if err != nil {
-		return nil, nil, err
+// sshChain holds the clients of a chain of SSH hops and the connection of the hop being connected,
+// so that they can be closed from another goroutine.
+type sshChain struct {
+	mu      sync.Mutex
+	clients []*ssh.Client
+	conn    net.Conn
+	closed  bool
+}
+
+// dialing records the connection of the hop being connected, closing it if the chain is already closed.
+func (c *sshChain) dialing(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	if c.closed {
+		conn.Close()
 	}
-	wait := make(chan error)
-	go func() {
-		wait <- client.Wait()
-	}()
-	go func() {
-		<-ctx.Done()
+}
+
+// add appends the client of a connected hop, closing it if the chain is already closed.
+func (c *sshChain) add(client *ssh.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = nil
+	if c.closed {
 		client.Close()
+		return net.ErrClosed
+	}
+	c.clients = append(c.clients, client)
+	return nil
+}
+
+// close closes the connection being connected and the clients, last hop first.
+func (c *sshChain) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	for i := len(c.clients) - 1; i >= 0; i-- {
+		c.clients[i].Close()
+	}
+}
+
+// dialChannel opens a tunneled connection over the client, giving up when the context is done.
+// A connection opened after giving up is closed.
+func dialChannel(ctx context.Context, client *ssh.Client, network, addr string) (net.Conn, error) {
+	if ctx.Done() == nil {
+		return client.Dial(network, addr)
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		result <- dialed{conn, err}
 	}()
-	return client, wait, nil
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialHop connects to the given hop, either via the previous hop's client or, for the first hop,
+// via Config.SSHConn or a new TCP connection. The connection is passed to dialing before the SSH handshake.
+func dialHop(ctx context.Context, config *Config, hop JumpHost, via *ssh.Client, dialing func(net.Conn)) (*ssh.Client, error) {
+	addr := withDefaultPort(hop.Addr, "22")
+	sshConfig := hop.SSHClient
+	if sshConfig == nil {
+		sshConfig = config.SSHClient
+	}
+	var authMethod string
+	if config.Auth != nil && sshConfig == config.SSHClient {
+		methods, err := config.Auth.methods(func(method string) { authMethod = method })
+		if err != nil {
+			return nil, err
+		}
+		sshConfigCopy := *sshConfig
+		sshConfigCopy.Auth = methods
+		sshConfig = &sshConfigCopy
+	}
+	observe(config.Observer, EventSSHConnecting{Addr: addr})
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	switch {
+	case via != nil:
+		conn, err = via.Dial("tcp", addr)
+	case config.SSHConn != nil:
+		conn = config.SSHConn
+	default:
+		dialer := net.Dialer{Timeout: sshConfig.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dialing(conn)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	observe(config.Observer, EventSSHHandshakeDone{Addr: addr, Duration: time.Since(start)})
+	if authMethod != "" {
+		observe(config.Observer, EventAuthMethodSucceeded{Addr: addr, User: sshConfig.User, Method: authMethod})
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func hopError(i, n int, hop JumpHost, err error) error {
+	if i == n-1 {
+		return fmt.Errorf("ssh server %s (via %d jump hosts): %v", hop.Addr, n-1, err)
+	}
+	return fmt.Errorf("jump host %d/%d %s: %v", i+1, n-1, hop.Addr, err)
 }
@@ -0,0 +1,40 @@
+package sshtunnel
+
+import "sync"
+
+// errorReporter sends errors on a channel without blocking. One buffer slot is reserved
+// for the final error, so that closing never blocks on a channel the caller does not drain.
+type errorReporter struct {
+	mu     sync.Mutex
+	ch     chan error
+	closed bool
+}
+
+func newErrorReporter() *errorReporter {
+	return &errorReporter{ch: make(chan error, 2)}
+}
+
+// report sends a non-fatal error, dropping it if the channel's buffer is (all but) full
+// or the reporter has been closed.
+func (r *errorReporter) report(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || len(r.ch) >= cap(r.ch)-1 {
+		return
+	}
+	r.ch <- err
+}
+
+// close sends the final error (if non-nil) and closes the channel.
+func (r *errorReporter) close(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if err != nil {
+		r.ch <- err
+	}
+	close(r.ch)
+}
@@ -0,0 +1,10 @@
+module github.com/sgreben/sshtunnel
+
+go 1.17
+
+require (
+	github.com/google/shlex v0.0.0-20181106134648-c34317bd91bf
+	golang.org/x/crypto v0.14.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
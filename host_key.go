@@ -0,0 +1,135 @@
+package sshtunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy is an SSH host key verification policy.
+//
+// A host key is accepted if it is listed for the host in one of the known_hosts files, or if its
+// fingerprint is pinned. Keys marked as revoked (`@revoked`) are always rejected. When TrustOnFirstUseFile
+// is set, keys of hosts that are not yet known are accepted and recorded in that file; keys of known hosts
+// that do not match are still rejected.
+type HostKeyPolicy struct {
+	// KnownHostsFiles are OpenSSH known_hosts files to check host keys against (optional).
+	// Hashed hostnames and the `@cert-authority` and `@revoked` markers are supported.
+	KnownHostsFiles []string
+	// TrustOnFirstUseFile is a known_hosts file to which keys of previously unknown hosts are appended (optional).
+	// It is also checked like the KnownHostsFiles; it is created if it does not exist.
+	TrustOnFirstUseFile string
+	// HashHostnames enables hashing of hostnames appended to the TrustOnFirstUseFile (optional).
+	HashHostnames bool
+	// Fingerprints are pinned host key fingerprints in SHA256 ("SHA256:...") or legacy MD5 form (optional).
+	Fingerprints []string
+}
+
+// Callback returns an ssh.HostKeyCallback implementing the policy, for use in ssh.ClientConfig.
+func (p HostKeyPolicy) Callback() (ssh.HostKeyCallback, error) {
+	files := append([]string(nil), p.KnownHostsFiles...)
+	if p.TrustOnFirstUseFile != "" {
+		if _, err := os.Stat(p.TrustOnFirstUseFile); err == nil {
+			files = append(files, p.TrustOnFirstUseFile)
+		}
+	}
+	db, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %v", err)
+	}
+	pinned := make(map[string]bool, len(p.Fingerprints))
+	for _, fingerprint := range p.Fingerprints {
+		pinned[fingerprint] = true
+	}
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := db(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var revokedErr *knownhosts.RevokedError
+		if errors.As(err, &revokedErr) {
+			return err
+		}
+		if isPinnedHostKey(pinned, key) {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 || p.TrustOnFirstUseFile == "" {
+			return err
+		}
+		if err := p.trust(hostname, key); err != nil {
+			return fmt.Errorf("trust host key for %s: %v", hostname, err)
+		}
+		db, err = knownhosts.New(append(append([]string(nil), p.KnownHostsFiles...), p.TrustOnFirstUseFile)...)
+		if err != nil {
+			return fmt.Errorf("reload known hosts: %v", err)
+		}
+		return nil
+	}, nil
+}
+
+func isPinnedHostKey(pinned map[string]bool, key ssh.PublicKey) bool {
+	keys := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		keys = append(keys, cert.Key)
+	}
+	for _, k := range keys {
+		if pinned[ssh.FingerprintSHA256(k)] || pinned[ssh.FingerprintLegacyMD5(k)] {
+			return true
+		}
+	}
+	return false
+}
+
+// trust appends a known_hosts line for the host key to the TrustOnFirstUseFile.
+// The line is appended with a single write, so that concurrent appends are not lost.
+func (p HostKeyPolicy) trust(hostname string, key ssh.PublicKey) error {
+	address := knownhosts.Normalize(hostname)
+	if p.HashHostnames {
+		address = knownhosts.HashHostname(address)
+	}
+	line := knownhosts.Line([]string{address}, key) + "\n"
+	path := p.TrustOnFirstUseFile
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if missingFinalNewline(path) {
+		line = "\n" + line
+	}
+	if _, err := f.Write([]byte(line)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// missingFinalNewline returns true if the file is not empty and does not end with a newline.
+func missingFinalNewline(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return false
+	}
+	return last[0] != '\n'
+}
@@ -0,0 +1,62 @@
+package sshtunnel
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrKeepAliveTimeout is the termination error of SSH connections closed due to missing keepalive replies.
+var ErrKeepAliveTimeout = errors.New("ssh: keepalive timeout")
+
+// ConfigKeepAlive is a keepalive configuration for an SSH connection.
+//
+// Every Interval, a `keepalive@openssh.com` global request is sent to the server (as with OpenSSH's
+// ServerAliveInterval). When no reply has been received for MaxMissed consecutive intervals, the
+// connection is closed and its wait channel receives ErrKeepAliveTimeout.
+type ConfigKeepAlive struct {
+	// Interval is the delay between keepalive requests (required).
+	Interval time.Duration
+	// MaxMissed is the number of missed replies after which the connection is closed (optional, default 3).
+	MaxMissed int
+}
+
+// run sends keepalive requests until the client disconnects (done is closed), or until too many replies
+// are missing, in which case it closes the client and returns ErrKeepAliveTimeout.
+func (c ConfigKeepAlive) run(client *ssh.Client, done <-chan struct{}) error {
+	maxMissed := c.MaxMissed
+	if maxMissed <= 0 {
+		maxMissed = 3
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	replies := make(chan error, 1)
+	outstanding := false
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return nil
+		case err := <-replies:
+			if err != nil {
+				return nil // the connection is gone; client.Wait reports why
+			}
+			outstanding, missed = false, 0
+		case <-ticker.C:
+			if outstanding {
+				missed++
+				if missed >= maxMissed {
+					client.Close()
+					return ErrKeepAliveTimeout
+				}
+				continue
+			}
+			outstanding = true
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
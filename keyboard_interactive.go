@@ -0,0 +1,108 @@
+package sshtunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// StaticAnswers returns a keyboard-interactive challenge callback that answers each question
+// with the answer whose key is the longest case-insensitive substring of the question.
+// The empty key matches any question. An error is returned for unmatched questions.
+func StaticAnswers(answers map[string]string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		out := make([]string, len(questions))
+		for i, question := range questions {
+			answer, ok := staticAnswer(answers, question)
+			if !ok {
+				return nil, fmt.Errorf("keyboard-interactive: no answer for question %q", question)
+			}
+			out[i] = answer
+		}
+		return out, nil
+	}
+}
+
+func staticAnswer(answers map[string]string, question string) (string, bool) {
+	question = strings.ToLower(question)
+	var answer, match string
+	ok := false
+	for key, value := range answers {
+		if !strings.Contains(question, strings.ToLower(key)) {
+			continue
+		}
+		if !ok || len(key) > len(match) {
+			answer, match, ok = value, key, true
+		}
+	}
+	return answer, ok
+}
+
+// TOTPAnswers returns a keyboard-interactive challenge callback that answers questions containing
+// `prompt` (case-insensitive; the empty prompt matches any question) with the current time-based
+// one-time password (RFC 6238; HMAC-SHA1, 30 second period, 6 digits) for the base32-encoded secret.
+//
+// Other questions are answered by `fallback` (optional), e.g. StaticAnswers.
+func TOTPAnswers(secret, prompt string, fallback ssh.KeyboardInteractiveChallenge) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		out := make([]string, len(questions))
+		var otherQuestions []string
+		var otherEchos []bool
+		var otherIndexes []int
+		for i, question := range questions {
+			if !strings.Contains(strings.ToLower(question), strings.ToLower(prompt)) {
+				otherQuestions = append(otherQuestions, question)
+				otherEchos = append(otherEchos, echos[i])
+				otherIndexes = append(otherIndexes, i)
+				continue
+			}
+			code, err := totp(secret, time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("keyboard-interactive: %v", err)
+			}
+			out[i] = code
+		}
+		if len(otherQuestions) == 0 {
+			return out, nil
+		}
+		if fallback == nil {
+			return nil, fmt.Errorf("keyboard-interactive: no answer for question %q", otherQuestions[0])
+		}
+		otherAnswers, err := fallback(user, instruction, otherQuestions, otherEchos)
+		if err != nil {
+			return nil, err
+		}
+		if len(otherAnswers) != len(otherQuestions) {
+			return nil, fmt.Errorf("keyboard-interactive: got %d answers for %d questions", len(otherAnswers), len(otherQuestions))
+		}
+		for i, answer := range otherAnswers {
+			out[otherIndexes[i]] = answer
+		}
+		return out, nil
+	}
+}
+
+// totp computes the RFC 6238 one-time password for the base32-encoded secret at time t.
+func totp(secret string, t time.Time) (string, error) {
+	const period = 30
+	const digits = 6
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("decode totp secret: %v", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/period))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, code%1000000), nil
+}
@@ -2,6 +2,7 @@ package sshtunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
@@ -17,68 +18,98 @@ func Listen(laddr net.Addr, network, addr string, config *Config, reconnectBacko
 // ListenContext serves an SSH tunnel to a remote address on the given local network address `laddr`.
 // The remote endpoint of the tunneled connections is given by the network and addr parameters.
 //
-// See func ReDial for a description of the network, addr, config and reconnectBackoff
-// parameters.
+// ListenContext is ListenWithOptionsContext with default options; the returned listener is the
+// underlying local listener.
 func ListenContext(ctx context.Context, laddr net.Addr, network, addr string, config *Config, reconnectBackoff backoff.Config) (net.Listener, chan error, error) {
-	listener, err := net.Listen(laddr.Network(), laddr.String())
+	listener, errCh, err := ListenWithOptionsContext(ctx, laddr, network, addr, config, reconnectBackoff, nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("listen on %s://%s: %v", laddr.Network(), laddr.String(), err)
+		return nil, nil, err
 	}
-	tunnelConnsCh, tunnelConnsErrCh := ReDialContext(ctx, network, addr, config, reconnectBackoff)
-	listenerConnsCh, _ := listenerConns(ctx, listener)
-	errCh := make(chan error, 1)
-	handleListenerConn := func(listenerConn net.Conn) {
-		ctxConn, cancel := context.WithCancel(ctx)
-		defer listenerConn.Close()
-		defer cancel()
-		for listenerConn.RemoteAddr() != net.Addr(nil) {
-			select {
-			case err := <-tunnelConnsErrCh:
-				errCh <- err
-				return
-			case <-ctx.Done():
-				errCh <- ctx.Err()
-				return
-			case tunnelConn, ok := <-tunnelConnsCh:
-				if !ok {
-					return
-				}
-				connpipe.Run(ctxConn, tunnelConn, listenerConn)
-			}
-		}
+	return listener.listener, errCh, nil
+}
+
+// ListenWithOptions is ListenWithOptionsContext with context.Background()
+func ListenWithOptions(laddr net.Addr, network, addr string, config *Config, reconnectBackoff backoff.Config, options *ListenOptions) (*TunnelListener, chan error, error) {
+	return ListenWithOptionsContext(context.Background(), laddr, network, addr, config, reconnectBackoff, options)
+}
+
+// ListenWithOptionsContext serves an SSH tunnel to a remote address on the given local network address `laddr`.
+// The remote endpoint of the tunneled connections is given by the network and addr parameters.
+//
+// Each accepted connection is paired with exactly one tunneled connection, opened when the
+// connection is accepted and closed when either side of it ends. The tunneled connections are
+// multiplexed over a single SSH client connection (see type Tunnel), which is re-connected on demand.
+// When a tunneled connection cannot be opened, the accepted connection is closed, or, if
+// options.OnDialFailure is DialFailureRetry, opening it is retried using the given back-off configuration.
+// Access restrictions, connection limits and TLS are configured via options as well (see ListenOptions).
+//
+// Cancelling the context closes the listener and all tunneled connections immediately;
+// use TunnelListener.Shutdown to drain active connections first.
+//
+// See func Dial for a description of the network, addr and config parameters.
+func ListenWithOptionsContext(ctx context.Context, laddr net.Addr, network, addr string, config *Config, reconnectBackoff backoff.Config, options *ListenOptions) (*TunnelListener, chan error, error) {
+	tunnel := NewTunnel(config, 1)
+	listener, errCh, err := tunnel.listen(ctx, laddr, network, addr, reconnectBackoff, options, func() { tunnel.close() })
+	if err != nil {
+		tunnel.close()
+		return nil, nil, err
 	}
-	go func() {
-		defer listener.Close()
-		defer close(errCh)
-		for {
-			select {
-			case <-ctx.Done():
-				errCh <- ctx.Err()
-				return
-			case listenerConn, ok := <-listenerConnsCh:
-				if !ok {
-					return
-				}
-				go handleListenerConn(listenerConn)
-			}
+	return listener, errCh, nil
+}
+
+func (t *Tunnel) listen(ctx context.Context, laddr net.Addr, network, addr string, reconnectBackoff backoff.Config, options *ListenOptions, cleanup func()) (*TunnelListener, chan error, error) {
+	policy, err := newListenPolicy(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := listenLocal(laddr, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	handleListenerConn := func(ctx context.Context, listenerConn net.Conn, pipe connpipe.Config) error {
+		dial := func() (net.Conn, <-chan error, error) {
+			return t.DialContext(ctx, network, addr)
 		}
-	}()
-	return listener, errCh, err
+		var tunnelConn net.Conn
+		var err error
+		switch options.onDialFailure() {
+		case DialFailureRetry:
+			tunnelConn, _, err = dialBackOff(ctx, dial, observeBackoff(reconnectBackoff, t.config.Observer))
+		default:
+			tunnelConn, _, err = dial()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: dial %s://%s: %v", listenerConn.RemoteAddr(), network, addr, err)
+		}
+		defer tunnelConn.Close()
+		result := pipe.Run(ctx, tunnelConn, listenerConn)
+		observe(t.config.Observer, EventSessionEnded{RemoteAddr: listenerConn.RemoteAddr(), Result: result})
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	l, errCh := serve(ctx, cancel, listener, t.config.Observer, policy, handleListenerConn, cleanup)
+	return l, errCh, nil
 }
 
+// listenerConns accepts connections from the listener. Accept errors (other than the listener
+// having been closed) are sent on the returned error channel.
 func listenerConns(ctx context.Context, listener net.Listener) (<-chan net.Conn, chan error) {
 	connCh := make(chan net.Conn)
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	go func() {
 		defer close(connCh)
 		defer close(errCh)
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					errCh <- err
+				}
 				return
 			}
 			select {
 			case <-ctx.Done():
+				conn.Close()
 				errCh <- ctx.Err()
 				return
 			case connCh <- conn:
@@ -0,0 +1,119 @@
+package sshtunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PeerCredentials restricts the local processes that may connect to a unix socket listener.
+// A process is allowed if its user ID is one of UIDs or its group ID is one of GIDs.
+type PeerCredentials struct {
+	UIDs []int
+	GIDs []int
+}
+
+func (p *PeerCredentials) allows(uid, gid int) bool {
+	for _, allowed := range p.UIDs {
+		if uid == allowed {
+			return true
+		}
+	}
+	for _, allowed := range p.GIDs {
+		if gid == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// accessControl enforces the access restrictions of ListenOptions.
+type accessControl struct {
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	authorize func(net.Conn) error
+	peer      *PeerCredentials
+}
+
+func newAccessControl(options *ListenOptions) (*accessControl, error) {
+	a := &accessControl{}
+	if options == nil {
+		return a, nil
+	}
+	var err error
+	if a.allow, err = parseNetworks(options.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %v", err)
+	}
+	if a.deny, err = parseNetworks(options.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %v", err)
+	}
+	a.authorize = options.Authorize
+	a.peer = options.PeerCredentials
+	return a, nil
+}
+
+// check returns nil if the source of the connection is permitted, and the reason for rejecting it otherwise.
+func (a *accessControl) check(conn net.Conn) error {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if containsIP(a.deny, addr.IP) || (len(a.allow) > 0 && !containsIP(a.allow, addr.IP)) {
+			return ErrSourceDenied
+		}
+	}
+	if a.peer != nil {
+		if _, ok := conn.(*net.UnixConn); ok {
+			uid, gid, err := peerCredentials(conn)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrPeerDenied, err)
+			}
+			if !a.peer.allows(uid, gid) {
+				return fmt.Errorf("%w: uid %d, gid %d", ErrPeerDenied, uid, gid)
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeConn calls the Authorize hook, if any, returning the reason for rejecting the connection.
+func (a *accessControl) authorizeConn(conn net.Conn) error {
+	if a.authorize == nil {
+		return nil
+	}
+	if err := a.authorize(conn); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return nil
+}
+
+// parseNetworks parses a list of CIDR networks. Plain IP addresses denote single-address networks.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ipNet)
+	}
+	return out, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package sshtunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sgreben/sshtunnel/tokenbucket"
+)
+
+// admission enforces the connection limits of ListenOptions.
+type admission struct {
+	maxConns     int
+	maxPerIP     int
+	policy       LimitPolicy
+	queueTimeout time.Duration
+	rate         *tokenbucket.Bucket // nil if the accept rate is unlimited
+
+	mu       sync.Mutex
+	active   int
+	perIP    map[string]int
+	released chan struct{} // closed and replaced whenever a connection is released
+}
+
+func newAdmission(options *ListenOptions) *admission {
+	a := &admission{
+		perIP:    make(map[string]int),
+		released: make(chan struct{}),
+	}
+	if options == nil {
+		return a
+	}
+	a.maxConns = options.MaxConns
+	a.maxPerIP = options.MaxConnsPerSourceIP
+	a.policy = options.OnLimit
+	a.queueTimeout = options.QueueTimeout
+	if options.AcceptRate > 0 {
+		a.rate = tokenbucket.New(options.AcceptRate, options.AcceptBurst)
+	}
+	return a
+}
+
+// accept applies the accept rate limit to a newly accepted connection.
+// With LimitQueue, it blocks until the connection may be accepted.
+func (a *admission) accept(ctx context.Context) error {
+	if a.rate == nil {
+		return nil
+	}
+	if a.policy != LimitQueue {
+		if !a.rate.Allow() {
+			return ErrAcceptRate
+		}
+		return nil
+	}
+	if a.queueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.queueTimeout)
+		defer cancel()
+	}
+	if err := a.rate.Wait(ctx); err != nil {
+		return ErrAcceptRate
+	}
+	return nil
+}
+
+// admit applies the connection count limits to an accepted connection. With LimitQueue, it blocks until
+// the connection can be admitted. The returned release func must be called after the connection has ended.
+func (a *admission) admit(ctx context.Context, conn net.Conn) (func(), error) {
+	ip := sourceIP(conn)
+	var timeout <-chan time.Time
+	if a.policy == LimitQueue && a.queueTimeout > 0 {
+		timer := time.NewTimer(a.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		a.mu.Lock()
+		err := a.limitLocked(ip)
+		if err == nil {
+			a.active++
+			if ip != "" {
+				a.perIP[ip]++
+			}
+			a.mu.Unlock()
+			return func() { a.release(ip) }, nil
+		}
+		released := a.released
+		a.mu.Unlock()
+		if a.policy != LimitQueue {
+			return nil, err
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (a *admission) limitLocked(ip string) error {
+	if a.maxConns > 0 && a.active >= a.maxConns {
+		return ErrMaxConns
+	}
+	if a.maxPerIP > 0 && ip != "" && a.perIP[ip] >= a.maxPerIP {
+		return ErrMaxConnsPerSourceIP
+	}
+	return nil
+}
+
+func (a *admission) release(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	if ip != "" {
+		if a.perIP[ip]--; a.perIP[ip] <= 0 {
+			delete(a.perIP, ip)
+		}
+	}
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// sourceIP returns the IP address of a TCP connection's remote endpoint, or "" for other connections.
+func sourceIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
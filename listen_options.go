@@ -0,0 +1,180 @@
+package sshtunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sgreben/sshtunnel/connpipe"
+)
+
+// Errors describing why a tunnel listener rejected a connection (see EventListenerRejected).
+var (
+	ErrMaxConns            = errors.New("too many connections")
+	ErrMaxConnsPerSourceIP = errors.New("too many connections from source IP")
+	ErrAcceptRate          = errors.New("accept rate exceeded")
+	ErrSourceDenied        = errors.New("source address not allowed")
+	ErrPeerDenied          = errors.New("peer credentials not allowed")
+	ErrUnauthorized        = errors.New("unauthorized")
+)
+
+// DialFailurePolicy determines how a tunnel listener handles an accepted connection
+// whose tunneled connection could not be opened.
+type DialFailurePolicy int
+
+const (
+	// DialFailureClose closes the accepted connection after a single failed attempt.
+	DialFailureClose DialFailurePolicy = iota
+	// DialFailureRetry retries opening the tunneled connection following the listener's back-off
+	// configuration, and closes the accepted connection only after all attempts have failed.
+	DialFailureRetry
+)
+
+// LimitPolicy determines how a tunnel listener handles connections exceeding its limits.
+type LimitPolicy int
+
+const (
+	// LimitReject closes connections exceeding a limit immediately.
+	LimitReject LimitPolicy = iota
+	// LimitQueue holds connections exceeding a limit until they can be admitted, until QueueTimeout
+	// has passed (then they are rejected), or until the listener is closed.
+	// While the accept rate is exceeded, no further connections are accepted.
+	LimitQueue
+)
+
+// ListenOptions are optional settings for tunnel listeners. A nil *ListenOptions uses the defaults.
+type ListenOptions struct {
+	// OnDialFailure is the policy for accepted connections whose tunneled connection could not be opened
+	// (optional, default DialFailureClose).
+	OnDialFailure DialFailurePolicy
+
+	// MaxConns is the maximum number of active connections (optional, 0 for no limit).
+	MaxConns int
+	// MaxConnsPerSourceIP is the maximum number of active connections from a single
+	// source IP address (optional, 0 for no limit). It applies only to TCP listeners.
+	MaxConnsPerSourceIP int
+	// AcceptRate is the maximum number of connections accepted per second (optional, 0 for no limit).
+	AcceptRate float64
+	// AcceptBurst is the number of connections that may be accepted at once, exceeding AcceptRate (optional, default 1).
+	AcceptBurst int
+	// OnLimit is the policy for connections exceeding the limits (optional, default LimitReject).
+	OnLimit LimitPolicy
+	// QueueTimeout is the maximum time a connection is held with LimitQueue (optional, 0 for no timeout).
+	QueueTimeout time.Duration
+
+	// Allow lists the networks (in CIDR notation, or single IP addresses) from which TCP connections
+	// are accepted (optional, default all).
+	Allow []string
+	// Deny lists the networks (in CIDR notation, or single IP addresses) from which TCP connections
+	// are rejected, taking precedence over Allow (optional).
+	Deny []string
+	// PeerCredentials restricts the processes that may connect to a unix socket listener (optional, Linux only).
+	PeerCredentials *PeerCredentials
+	// Authorize is called for each accepted connection that passed the other checks, before its tunneled
+	// connection is opened. The connection is rejected if it returns an error (optional).
+	// For TLS listeners, it is called with the *tls.Conn after the handshake.
+	Authorize func(net.Conn) error
+
+	// TLSConfig enables TLS on the listener (optional). Connections are decrypted locally and their
+	// plaintext is tunneled. Client certificates are verified as configured by TLSConfig.ClientAuth.
+	TLSConfig *tls.Config
+	// TLSHandshakeTimeout is the maximum duration of the TLS handshake (optional, default 10s).
+	TLSHandshakeTimeout time.Duration
+
+	// IdleTimeout is the duration without data transferred in either direction after which
+	// a connection is closed (optional, 0 for no timeout).
+	IdleTimeout time.Duration
+	// MaxLifetime is the duration after which a connection is closed, regardless of activity (optional, 0 for no limit).
+	MaxLifetime time.Duration
+
+	// RateIn limits the rate (in bytes per second) of data received from all clients of the listener
+	// (optional, 0 for no limit). See TunnelListener.SetRateLimit.
+	RateIn float64
+	// RateOut limits the rate (in bytes per second) of data sent to all clients of the listener
+	// (optional, 0 for no limit). See TunnelListener.SetRateLimit.
+	RateOut float64
+	// ConnRateIn limits the rate (in bytes per second) of data received from each client connection
+	// (optional, 0 for no limit). See TunnelListener.SetConnRateLimit.
+	ConnRateIn float64
+	// ConnRateOut limits the rate (in bytes per second) of data sent to each client connection
+	// (optional, 0 for no limit). See TunnelListener.SetConnRateLimit.
+	ConnRateOut float64
+
+	// Tap is called for each connection with the tunneled connection (a) and the client connection (b),
+	// and returns a connpipe.Tap receiving a copy of the connection's data, or nil (optional).
+	// See connpipe.HexdumpWriter.Tap and connpipe.PcapngWriter.Tap.
+	Tap func(a, b net.Conn) connpipe.Tap
+
+	// The following options apply to unix socket listeners only. Socket files are removed when the listener is closed.
+
+	// SocketMode is the file mode of the socket file (optional, default as created by the OS).
+	SocketMode os.FileMode
+	// SocketUID is the owner user ID of the socket file (optional).
+	SocketUID *int
+	// SocketGID is the owner group ID of the socket file (optional).
+	SocketGID *int
+	// RemoveStaleSocket enables removing an existing socket file at the listen address
+	// if no process accepts connections on it (optional).
+	RemoveStaleSocket bool
+	// CreateSocketDir enables creating missing parent directories of the socket file, with mode 0700 (optional).
+	CreateSocketDir bool
+}
+
+func (o *ListenOptions) onDialFailure() DialFailurePolicy {
+	if o == nil {
+		return DialFailureClose
+	}
+	return o.OnDialFailure
+}
+
+// listenPolicy enforces the access restrictions and connection limits of ListenOptions.
+type listenPolicy struct {
+	access              *accessControl
+	admission           *admission
+	tlsConfig           *tls.Config
+	tlsHandshakeTimeout time.Duration
+	pipe                connpipe.Config
+	rateIn, rateOut     float64
+	connRateIn          float64
+	connRateOut         float64
+}
+
+func newListenPolicy(options *ListenOptions) (*listenPolicy, error) {
+	access, err := newAccessControl(options)
+	if err != nil {
+		return nil, fmt.Errorf("listen options: %v", err)
+	}
+	policy := &listenPolicy{access: access, admission: newAdmission(options)}
+	if options == nil {
+		return policy, nil
+	}
+	policy.pipe = connpipe.Config{IdleTimeout: options.IdleTimeout, MaxLifetime: options.MaxLifetime, Tap: options.Tap}
+	policy.rateIn, policy.rateOut = options.RateIn, options.RateOut
+	policy.connRateIn, policy.connRateOut = options.ConnRateIn, options.ConnRateOut
+	if options.TLSConfig != nil {
+		policy.tlsConfig = options.TLSConfig
+		policy.tlsHandshakeTimeout = options.TLSHandshakeTimeout
+		if policy.tlsHandshakeTimeout <= 0 {
+			policy.tlsHandshakeTimeout = 10 * time.Second
+		}
+	}
+	return policy, nil
+}
+
+// serverTLS performs the server side of a TLS handshake on conn if TLS is enabled, and returns conn otherwise.
+func (p *listenPolicy) serverTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if p.tlsConfig == nil {
+		return conn, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Server(conn, p.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("tls handshake with %s: %v", conn.RemoteAddr(), err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,101 @@
+package sshtunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/sgreben/sshtunnel/backoff"
+	"github.com/sgreben/sshtunnel/connpipe"
+	"golang.org/x/crypto/ssh"
+)
+
+// ListenRemote is ListenRemoteContext with context.Background()
+func ListenRemote(remoteAddr, localNetwork, localAddr string, config *Config, reconnectBackoff backoff.Config) (<-chan error, error) {
+	return ListenRemoteContext(context.Background(), remoteAddr, localNetwork, localAddr, config, reconnectBackoff)
+}
+
+// ListenRemoteContext requests the SSH server to listen on the TCP address `remoteAddr` (remote port forwarding, `ssh -R`)
+// and connects each connection accepted there to the local address `localAddr` on the named network `localNetwork`.
+//
+// The remote forward is established before ListenRemoteContext returns. When the SSH connection drops, the
+// forward is re-established following the given back-off configuration. The returned channel receives
+// errors for individual forwarded connections and is closed after the forward could not be re-established
+// or the context is cancelled.
+//
+// See func Dial for a description of the supported local networks.
+func ListenRemoteContext(ctx context.Context, remoteAddr, localNetwork, localAddr string, config *Config, reconnectBackoff backoff.Config) (<-chan error, error) {
+	forward := func() (*ssh.Client, <-chan error, net.Listener, error) {
+		return listenRemote(ctx, remoteAddr, config, reconnectBackoff)
+	}
+	client, wait, listener, err := forward()
+	if err != nil {
+		return nil, err
+	}
+	observer := config.Observer
+	errs := newErrorReporter()
+	handleRemoteConn := func(remoteConn net.Conn) {
+		defer remoteConn.Close()
+		observe(observer, EventListenerAccepted{LocalAddr: remoteConn.LocalAddr(), RemoteAddr: remoteConn.RemoteAddr()})
+		localConn, err := net.Dial(localNetwork, localAddr)
+		if err != nil {
+			err = fmt.Errorf("dial %s://%s: %v", localNetwork, localAddr, err)
+			observe(observer, EventError{Err: err})
+			errs.report(err)
+			return
+		}
+		defer localConn.Close()
+		result := connpipe.Run(ctx, remoteConn, localConn)
+		observe(observer, EventSessionEnded{RemoteAddr: remoteConn.RemoteAddr(), Result: result})
+	}
+	go func() {
+		for {
+			for {
+				remoteConn, err := listener.Accept()
+				if err != nil {
+					break
+				}
+				go handleRemoteConn(remoteConn)
+			}
+			listener.Close()
+			client.Close()
+			<-wait
+			select {
+			case <-ctx.Done():
+				observe(observer, EventTunnelClosed{Cause: ctx.Err()})
+				errs.close(ctx.Err())
+				return
+			default:
+			}
+			client, wait, listener, err = forward()
+			if err != nil {
+				observe(observer, EventTunnelClosed{Cause: err})
+				errs.close(err)
+				return
+			}
+		}
+	}()
+	return errs.ch, nil
+}
+
+func listenRemote(ctx context.Context, remoteAddr string, config *Config, backoffConfig backoff.Config) (*ssh.Client, <-chan error, net.Listener, error) {
+	var client *ssh.Client
+	var wait <-chan error
+	var listener net.Listener
+	backoffConfig = observeBackoff(backoffConfig, config.Observer)
+	errOut := backoffConfig.Run(ctx, func() error {
+		var err error
+		client, wait, err = connectSSH(ctx, config)
+		if err != nil {
+			return err
+		}
+		listener, err = client.Listen("tcp", remoteAddr)
+		if err != nil {
+			client.Close()
+			<-wait
+			return fmt.Errorf("remote listen on %s: %v", remoteAddr, err)
+		}
+		return nil
+	})
+	return client, wait, listener, errOut
+}
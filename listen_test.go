@@ -0,0 +1,289 @@
+package sshtunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sgreben/sshtunnel/backoff"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an in-process SSH server whose direct-tcpip channels echo their data.
+type testSSHServer struct {
+	addr   string
+	client *ssh.ClientConfig
+
+	mu       sync.Mutex
+	opened   int      // number of direct-tcpip channel requests
+	reject   int      // number of channel requests still to reject
+	received []string // data received on each finished channel
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &testSSHServer{
+		addr: listener.Addr().String(),
+		client: &ssh.ClientConfig{
+			User:            "user",
+			Auth:            []ssh.AuthMethod{ssh.Password("password")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		s.mu.Lock()
+		s.opened++
+		reject := s.reject > 0
+		if reject {
+			s.reject--
+		}
+		s.mu.Unlock()
+		if reject {
+			newChannel.Reject(ssh.ConnectionFailed, "rejected")
+			continue
+		}
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(channelReqs)
+		go func() {
+			var data bytes.Buffer
+			io.Copy(io.MultiWriter(channel, &data), channel)
+			channel.Close()
+			s.mu.Lock()
+			s.received = append(s.received, data.String())
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *testSSHServer) stats() (opened int, received []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opened, append([]string(nil), s.received...)
+}
+
+// waitReceived waits until n channels have finished and returns their data.
+func (s *testSSHServer) waitReceived(t *testing.T, n int) []string {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		_, received := s.stats()
+		if len(received) >= n {
+			return received
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d channels finished, want %d", len(received), n)
+		}
+	}
+}
+
+func testListen(t *testing.T, s *testSSHServer, options *ListenOptions, reconnectBackoff backoff.Config) (*TunnelListener, chan error) {
+	config := &Config{SSHAddr: s.addr, SSHClient: s.client}
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, errCh, err := ListenWithOptions(laddr, "tcp", "127.0.0.1:7", config, reconnectBackoff, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener, errCh
+}
+
+// echo sends the message over a new connection to the listener and checks that it is echoed back.
+func echo(t *testing.T, listener *TunnelListener, message string) {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Error(err)
+		return
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Error(err)
+		return
+	}
+	if string(reply) != message {
+		t.Errorf("reply = %q, want %q", reply, message)
+	}
+}
+
+func TestListenOneChannelPerConn(t *testing.T) {
+	const n = 10
+	s := newTestSSHServer(t)
+	listener, _ := testListen(t, s, nil, backoff.Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			echo(t, listener, fmt.Sprintf("concurrent %d", i))
+		}(i)
+	}
+	wg.Wait()
+	s.waitReceived(t, n)
+	// Channels must not be reused after their pipe has ended.
+	for i := 0; i < n; i++ {
+		echo(t, listener, fmt.Sprintf("sequential %d", i))
+		s.waitReceived(t, n+i+1)
+	}
+
+	opened, received := s.stats()
+	if opened != 2*n || len(received) != 2*n {
+		t.Fatalf("%d channels opened, %d finished, want %d", opened, len(received), 2*n)
+	}
+	seen := make(map[string]bool)
+	for _, data := range received {
+		if seen[data] {
+			t.Errorf("%q received on more than one channel", data)
+		}
+		seen[data] = true
+	}
+	for i := 0; i < n; i++ {
+		for _, message := range []string{fmt.Sprintf("concurrent %d", i), fmt.Sprintf("sequential %d", i)} {
+			if !seen[message] {
+				t.Errorf("%q not received on its own channel", message)
+			}
+		}
+	}
+}
+
+func TestListenDialFailureClose(t *testing.T) {
+	s := newTestSSHServer(t)
+	s.reject = 1
+	listener, errCh := testListen(t, s, &ListenOptions{OnDialFailure: DialFailureClose}, backoff.Config{})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %d, %v, want EOF", n, err)
+	}
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("error channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dial error reported")
+	}
+	if opened, _ := s.stats(); opened != 1 {
+		t.Fatalf("%d channels requested, want 1", opened)
+	}
+
+	// The next connection gets a new channel.
+	echo(t, listener, "after failure")
+	if opened, _ := s.stats(); opened != 2 {
+		t.Fatalf("%d channels requested, want 2", opened)
+	}
+}
+
+func TestListenDialFailureRetry(t *testing.T) {
+	s := newTestSSHServer(t)
+	s.reject = 2
+	reconnectBackoff := backoff.Config{Min: time.Millisecond, Max: 10 * time.Millisecond, MaxAttempts: 5}
+	listener, _ := testListen(t, s, &ListenOptions{OnDialFailure: DialFailureRetry}, reconnectBackoff)
+
+	echo(t, listener, "after retries")
+	s.waitReceived(t, 1)
+	if opened, _ := s.stats(); opened != 3 {
+		t.Fatalf("%d channels requested, want 3", opened)
+	}
+}
+
+func TestListenCloseWhileConnecting(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, _, err := ListenWithOptions(laddr, "tcp", "127.0.0.1:7", silentServerConfig(t), backoff.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := listener.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	listener.Close()
+	select {
+	case <-listener.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener not done after Close")
+	}
+}
+
+func TestListenCloseListener(t *testing.T) {
+	s := newTestSSHServer(t)
+	config := &Config{SSHAddr: s.addr, SSHClient: s.client}
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, errCh, err := Listen(laddr, "tcp", "127.0.0.1:7", config, backoff.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	select {
+	case err, ok := <-errCh:
+		if ok {
+			t.Fatalf("err = %v, want closed channel", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("error channel not closed after closing the listener")
+	}
+}
@@ -0,0 +1,241 @@
+// Package metrics collects Prometheus-style metrics for SSH tunnels.
+//
+// A *Metrics is an sshtunnel.Observer; set it as (or add it to) sshtunnel.Config.Observer to collect metrics.
+// The collected metrics are available as a Snapshot, and in the Prometheus text exposition format via ServeHTTP.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sgreben/sshtunnel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultBuckets are the default latency histogram bucket upper bounds, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects tunnel metrics from sshtunnel lifecycle events.
+type Metrics struct {
+	mu                  sync.Mutex
+	handshakeSeconds    *histogram
+	channelOpenSeconds  *histogram
+	channelsActive      *vector
+	channelsOpened      *vector
+	bytes               *vector // bytes of closed channels
+	openChannels        map[*sshtunnel.ChannelBytes]bool
+	connectionsAccepted *vector
+	connectionsRejected *vector
+	sessionsEnded       *vector
+	sshDisconnects      *vector
+	retries             *vector
+	reconnectFailures   *vector
+	errors              *vector
+}
+
+// New returns an empty Metrics using the DefaultBuckets for its histograms.
+func New() *Metrics {
+	return &Metrics{
+		handshakeSeconds:    newHistogram("sshtunnel_ssh_handshake_seconds", "Duration of SSH handshakes (including authentication).", DefaultBuckets),
+		channelOpenSeconds:  newHistogram("sshtunnel_channel_open_seconds", "Duration of opening tunneled connections (SSH channels).", DefaultBuckets),
+		channelsActive:      newVector("sshtunnel_channels_active", "Number of open tunneled connections.", typeGauge, ""),
+		channelsOpened:      newVector("sshtunnel_channels_opened_total", "Total number of tunneled connections opened.", typeCounter, ""),
+		bytes:               newVector("sshtunnel_bytes_total", "Total bytes transferred over tunneled connections.", typeCounter, "direction"),
+		openChannels:        make(map[*sshtunnel.ChannelBytes]bool),
+		connectionsAccepted: newVector("sshtunnel_listener_accepted_total", "Total number of connections accepted by tunnel listeners.", typeCounter, ""),
+		connectionsRejected: newVector("sshtunnel_listener_rejected_total", "Total number of connections rejected by tunnel listeners, by reason.", typeCounter, "reason"),
+		sessionsEnded:       newVector("sshtunnel_sessions_ended_total", "Total number of ended tunneled sessions, by reason.", typeCounter, "reason"),
+		sshDisconnects:      newVector("sshtunnel_ssh_disconnects_total", "Total number of terminated SSH connections, by error class.", typeCounter, "class"),
+		retries:             newVector("sshtunnel_reconnect_attempts_total", "Total number of failed attempts that were retried, by error class.", typeCounter, "class"),
+		reconnectFailures:   newVector("sshtunnel_reconnect_failures_total", "Total number of reconnects given up after the last attempt, by error class.", typeCounter, "class"),
+		errors:              newVector("sshtunnel_errors_total", "Total number of non-fatal errors, by error class.", typeCounter, "class"),
+	}
+}
+
+// Observe updates the metrics for the given event.
+func (m *Metrics) Observe(event sshtunnel.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch e := event.(type) {
+	case sshtunnel.EventSSHHandshakeDone:
+		m.handshakeSeconds.observe(e.Duration.Seconds())
+	case sshtunnel.EventSSHDisconnected:
+		m.sshDisconnects.add(ErrorClass(e.Err), 1)
+	case sshtunnel.EventBackoff:
+		m.retries.add(ErrorClass(e.Err), 1)
+	case sshtunnel.EventBackoffExhausted:
+		m.reconnectFailures.add(ErrorClass(e.Err), 1)
+	case sshtunnel.EventChannelOpened:
+		m.channelOpenSeconds.observe(e.Duration.Seconds())
+		m.channelsOpened.add("", 1)
+		m.channelsActive.add("", 1)
+		if e.Bytes != nil {
+			m.openChannels[e.Bytes] = true
+		}
+	case sshtunnel.EventChannelClosed:
+		m.channelsActive.add("", -1)
+		delete(m.openChannels, e.Bytes)
+		m.bytes.add("read", float64(e.BytesRead))
+		m.bytes.add("written", float64(e.BytesWritten))
+	case sshtunnel.EventListenerAccepted:
+		m.connectionsAccepted.add("", 1)
+	case sshtunnel.EventListenerRejected:
+		m.connectionsRejected.add(rejectReason(e.Reason), 1)
+	case sshtunnel.EventSessionEnded:
+		m.sessionsEnded.add(string(e.Result.Reason), 1)
+	case sshtunnel.EventError:
+		m.errors.add(ErrorClass(e.Err), 1)
+	}
+}
+
+// Collect returns a snapshot of the current metric values.
+func (m *Metrics) Collect() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var s Snapshot
+	for _, v := range []*vector{m.channelsActive, m.channelsOpened, m.liveBytes(), m.connectionsAccepted, m.connectionsRejected, m.sessionsEnded, m.sshDisconnects, m.retries, m.reconnectFailures, m.errors} {
+		s.Metrics = append(s.Metrics, v.snapshot())
+	}
+	for _, h := range []*histogram{m.handshakeSeconds, m.channelOpenSeconds} {
+		s.Histograms = append(s.Histograms, h.snapshot())
+	}
+	return s
+}
+
+// liveBytes returns the byte counts of the closed channels plus those of the open channels so far.
+func (m *Metrics) liveBytes() *vector {
+	v := newVector(m.bytes.name, m.bytes.help, m.bytes.typ, m.bytes.label)
+	for labelValue, value := range m.bytes.values {
+		v.values[labelValue] = value
+	}
+	for bytes := range m.openChannels {
+		v.add("read", float64(bytes.Read()))
+		v.add("written", float64(bytes.Written()))
+	}
+	return v
+}
+
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, sshtunnel.ErrMaxConns):
+		return "max_conns"
+	case errors.Is(err, sshtunnel.ErrMaxConnsPerSourceIP):
+		return "max_conns_per_source_ip"
+	case errors.Is(err, sshtunnel.ErrAcceptRate):
+		return "accept_rate"
+	case errors.Is(err, sshtunnel.ErrSourceDenied):
+		return "source_denied"
+	case errors.Is(err, sshtunnel.ErrPeerDenied):
+		return "peer_denied"
+	case errors.Is(err, sshtunnel.ErrUnauthorized):
+		return "unauthorized"
+	}
+	return "other"
+}
+
+// ErrorClass returns a coarse classification of an error, as used for the "class" label.
+func ErrorClass(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var openChannelErr *ssh.OpenChannelError
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	switch {
+	case err == nil:
+		return "none"
+	case errors.Is(err, sshtunnel.ErrKeepAliveTimeout):
+		return "keepalive"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &openChannelErr):
+		return "channel"
+	case errors.As(err, &keyErr), errors.As(err, &revokedErr):
+		return "host_key"
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return "auth"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	default:
+		return "other"
+	}
+}
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// vector is a counter or gauge with at most one label.
+type vector struct {
+	name, help, typ, label string
+	values                 map[string]float64
+}
+
+func newVector(name, help, typ, label string) *vector {
+	return &vector{name: name, help: help, typ: typ, label: label, values: make(map[string]float64)}
+}
+
+func (v *vector) add(labelValue string, delta float64) {
+	v.values[labelValue] += delta
+}
+
+func (v *vector) snapshot() Metric {
+	out := Metric{Name: v.name, Help: v.help, Type: v.typ}
+	if v.label == "" {
+		out.Samples = []Sample{{Value: v.values[""]}}
+		return out
+	}
+	for labelValue, value := range v.values {
+		out.Samples = append(out.Samples, Sample{
+			Labels: map[string]string{v.label: labelValue},
+			Value:  value,
+		})
+	}
+	sort.Slice(out.Samples, func(i, j int) bool {
+		return out.Samples[i].Labels[v.label] < out.Samples[j].Labels[v.label]
+	})
+	return out
+}
+
+type histogram struct {
+	name, help string
+	bounds     []float64
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{Name: h.name, Help: h.help, Sum: h.sum, Count: h.count}
+	for i, bound := range h.bounds {
+		out.Buckets = append(out.Buckets, Bucket{UpperBound: bound, Count: h.counts[i]})
+	}
+	return out
+}
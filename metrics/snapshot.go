@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Snapshot is a point-in-time copy of the collected metrics.
+type Snapshot struct {
+	Metrics    []Metric
+	Histograms []Histogram
+}
+
+// Metric is a counter or gauge.
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string // "counter" or "gauge"
+	Samples []Sample
+}
+
+// Sample is a single labelled value of a Metric.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Histogram is a cumulative histogram.
+type Histogram struct {
+	Name    string
+	Help    string
+	Buckets []Bucket
+	Sum     float64
+	Count   uint64
+}
+
+// Bucket is a histogram bucket, counting the observations less than or equal to its UpperBound.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// WriteText writes the snapshot in the Prometheus text exposition format (version 0.0.4).
+func (s Snapshot) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, m := range s.Metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+		for _, sample := range m.Samples {
+			fmt.Fprintf(&b, "%s%s %s\n", m.Name, formatLabels(sample.Labels), formatValue(sample.Value))
+		}
+	}
+	for _, h := range s.Histograms {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+		for _, bucket := range h.Buckets {
+			le := map[string]string{"le": formatValue(bucket.UpperBound)}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", h.Name, formatLabels(le), bucket.Count)
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", h.Name, h.Count)
+		fmt.Fprintf(&b, "%s_sum %s\n%s_count %d\n", h.Name, formatValue(h.Sum), h.Name, h.Count)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP serves the current metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Collect().WriteText(w)
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
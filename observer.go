@@ -0,0 +1,222 @@
+package sshtunnel
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgreben/sshtunnel/connpipe"
+)
+
+// Observer receives tunnel lifecycle events (see Config.Observer).
+//
+// Observe may be called concurrently from multiple goroutines and should not block.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc is an Observer function.
+type ObserverFunc func(Event)
+
+// Observe calls f(event).
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// Observers is an Observer that passes each event to all of its elements in order.
+type Observers []Observer
+
+// Observe calls Observe(event) on each of the observers.
+func (o Observers) Observe(event Event) {
+	for _, observer := range o {
+		observer.Observe(event)
+	}
+}
+
+// Event is a tunnel lifecycle event. It is one of the Event* types in this package.
+type Event interface {
+	event()
+}
+
+// EventSSHConnecting is emitted before connecting to an SSH server (or jump host).
+type EventSSHConnecting struct {
+	Addr string
+}
+
+// EventSSHHandshakeDone is emitted after the SSH handshake with a server (or jump host) has completed.
+type EventSSHHandshakeDone struct {
+	Addr     string
+	Duration time.Duration
+}
+
+// EventAuthMethodSucceeded is emitted after authentication to a server (or jump host) succeeded.
+// It is only emitted for connections authenticated using Config.Auth.
+type EventAuthMethodSucceeded struct {
+	Addr   string
+	User   string
+	Method string
+}
+
+// EventSSHDisconnected is emitted after the SSH client connection to a server has terminated.
+type EventSSHDisconnected struct {
+	Addr string
+	Err  error
+}
+
+// EventBackoff is emitted after a failed attempt, before waiting to retry.
+type EventBackoff struct {
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
+// EventBackoffExhausted is emitted after the last failed attempt, when no more attempts are made.
+type EventBackoffExhausted struct {
+	Attempts int
+	Err      error
+}
+
+// EventChannelOpened is emitted after a tunneled connection (an SSH channel) has been opened.
+// Bytes are its byte counts, updated as data is transferred.
+type EventChannelOpened struct {
+	Network  string
+	Addr     string
+	Duration time.Duration
+	Bytes    *ChannelBytes
+}
+
+// EventChannelClosed is emitted after a tunneled connection (an SSH channel) has been closed.
+// BytesRead are the bytes received from, BytesWritten the bytes sent to the remote endpoint.
+// Bytes are the same counts as in the connection's EventChannelOpened.
+type EventChannelClosed struct {
+	Network      string
+	Addr         string
+	BytesRead    int64
+	BytesWritten int64
+	Bytes        *ChannelBytes
+}
+
+// ChannelBytes are the byte counts of a tunneled connection, updated as data is transferred.
+type ChannelBytes struct {
+	read    int64
+	written int64
+}
+
+// Read returns the number of bytes received from the remote endpoint so far.
+func (b *ChannelBytes) Read() int64 {
+	return atomic.LoadInt64(&b.read)
+}
+
+// Written returns the number of bytes sent to the remote endpoint so far.
+func (b *ChannelBytes) Written() int64 {
+	return atomic.LoadInt64(&b.written)
+}
+
+// EventListenerAccepted is emitted after a tunnel listener accepted a connection.
+type EventListenerAccepted struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// EventListenerRejected is emitted after a tunnel listener rejected an accepted connection
+// due to its access restrictions or limits (see ListenOptions). Reason is (or wraps) one of ErrMaxConns,
+// ErrMaxConnsPerSourceIP, ErrAcceptRate, ErrSourceDenied, ErrPeerDenied and ErrUnauthorized.
+type EventListenerRejected struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Reason     error
+}
+
+// EventSessionEnded is emitted after a connection served through a tunnel (by a tunnel listener
+// or a remote forward) has ended. In the Result, A is the tunneled connection and B the served connection;
+// its Reason tells sessions closed due to limits apart from those that ended normally or failed.
+type EventSessionEnded struct {
+	RemoteAddr net.Addr
+	Result     connpipe.Result
+}
+
+// EventError is emitted for errors that do not end the tunnel, such as failures of individual connections.
+type EventError struct {
+	Err error
+}
+
+// EventTunnelClosed is emitted after a tunnel listener (or Tunnel) has been torn down.
+type EventTunnelClosed struct {
+	Cause error
+}
+
+func (EventSSHConnecting) event()       {}
+func (EventSSHHandshakeDone) event()    {}
+func (EventAuthMethodSucceeded) event() {}
+func (EventSSHDisconnected) event()     {}
+func (EventBackoff) event()             {}
+func (EventBackoffExhausted) event()    {}
+func (EventChannelOpened) event()       {}
+func (EventChannelClosed) event()       {}
+func (EventListenerAccepted) event()    {}
+func (EventListenerRejected) event()    {}
+func (EventSessionEnded) event()        {}
+func (EventError) event()               {}
+func (EventTunnelClosed) event()        {}
+
+func observe(observer Observer, event Event) {
+	if observer != nil {
+		observer.Observe(event)
+	}
+}
+
+// observedConn counts the bytes transferred over a tunneled connection and emits EventChannelClosed when it is closed.
+type observedConn struct {
+	net.Conn
+	observer  Observer
+	network   string
+	addr      string
+	bytes     ChannelBytes
+	closeOnce sync.Once
+}
+
+// observeConn wraps a newly opened tunneled connection, emitting EventChannelOpened.
+// If the observer is nil, the connection is returned as is.
+func observeConn(conn net.Conn, observer Observer, network, addr string, start time.Time) net.Conn {
+	if observer == nil {
+		return conn
+	}
+	c := &observedConn{Conn: conn, observer: observer, network: network, addr: addr}
+	observer.Observe(EventChannelOpened{Network: network, Addr: addr, Duration: time.Since(start), Bytes: &c.bytes})
+	return c
+}
+
+func (c *observedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.bytes.read, int64(n))
+	return n, err
+}
+
+func (c *observedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.bytes.written, int64(n))
+	return n, err
+}
+
+func (c *observedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.New("ssh: observedConn: CloseWrite not supported")
+}
+
+func (c *observedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.observer.Observe(EventChannelClosed{
+			Network:      c.network,
+			Addr:         c.addr,
+			BytesRead:    c.bytes.Read(),
+			BytesWritten: c.bytes.Written(),
+			Bytes:        &c.bytes,
+		})
+	})
+	return err
+}
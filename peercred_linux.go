@@ -0,0 +1,31 @@
+package sshtunnel
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the user and group ID of the process on the other end of a unix socket connection.
+func peerCredentials(conn net.Conn) (uid, gid int, err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, fmt.Errorf("peer credentials: not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, 0, fmt.Errorf("peer credentials: %v", err)
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("peer credentials: %v", err)
+	}
+	return int(cred.Uid), int(cred.Gid), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package sshtunnel
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials returns the user and group ID of the process on the other end of a unix socket connection.
+// It is only supported on Linux.
+func peerCredentials(conn net.Conn) (uid, gid int, err error) {
+	return 0, 0, errors.New("peer credentials: not supported on this platform")
+}
@@ -3,6 +3,7 @@ package sshtunnel
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/sgreben/sshtunnel/backoff"
 )
@@ -30,6 +31,11 @@ func ReDialContext(ctx context.Context, network, addr string, config *Config, ba
 	dial := func() (net.Conn, <-chan error, error) {
 		return DialContext(ctx, network, addr, config)
 	}
+	return reDial(ctx, dial, backoffConfig, config.Observer)
+}
+
+func reDial(ctx context.Context, dial func() (net.Conn, <-chan error, error), backoffConfig backoff.Config, observer Observer) (<-chan net.Conn, <-chan error) {
+	backoffConfig = observeBackoff(backoffConfig, observer)
 	dialBackOff := func() (net.Conn, <-chan error, error) {
 		return dialBackOff(ctx, dial, backoffConfig)
 	}
@@ -66,3 +72,26 @@ func dialBackOff(ctx context.Context, dial func() (net.Conn, <-chan error, error
 	})
 	return conn, connClosedCh, errOut
 }
+
+// observeBackoff returns the back-off configuration extended to emit EventBackoff on retries,
+// and EventBackoffExhausted when giving up.
+func observeBackoff(config backoff.Config, observer Observer) backoff.Config {
+	if observer == nil {
+		return config
+	}
+	onRetry := config.OnRetry
+	config.OnRetry = func(attempt int, delay time.Duration, err error) {
+		observer.Observe(EventBackoff{Attempt: attempt, Delay: delay, Err: err})
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+	}
+	onGiveUp := config.OnGiveUp
+	config.OnGiveUp = func(attempts int, err error) {
+		observer.Observe(EventBackoffExhausted{Attempts: attempts, Err: err})
+		if onGiveUp != nil {
+			onGiveUp(attempts, err)
+		}
+	}
+	return config
+}
@@ -0,0 +1,222 @@
+package sshtunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sgreben/sshtunnel/connpipe"
+)
+
+const (
+	socks5Version         = 0x05
+	socks5AuthVersion     = 0x01
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5AuthUnavailable = 0xFF
+	socks5CmdConnect      = 0x01
+	socks5AddrIPv4        = 0x01
+	socks5AddrDomain      = 0x03
+	socks5AddrIPv6        = 0x04
+
+	socks5ReplySucceeded            = 0x00
+	socks5ReplyGeneralFailure       = 0x01
+	socks5ReplyHostUnreachable      = 0x04
+	socks5ReplyCommandNotSupported  = 0x07
+	socks5ReplyAddrTypeNotSupported = 0x08
+)
+
+// socks5HandshakeTimeout is the maximum duration of a SOCKS5 client's handshake.
+const socks5HandshakeTimeout = 10 * time.Second
+
+// ListenSOCKS5 is ListenSOCKS5Context with context.Background()
+func ListenSOCKS5(laddr net.Addr, config *Config, credentials map[string]string, options *ListenOptions) (*TunnelListener, chan error, error) {
+	return ListenSOCKS5Context(context.Background(), laddr, config, credentials, options)
+}
+
+// ListenSOCKS5Context serves a SOCKS5 proxy on the given local network address `laddr` (dynamic port forwarding, `ssh -D`).
+// Each CONNECT request is fulfilled by dialing the requested destination through a single shared SSH client connection.
+//
+// When `credentials` is non-nil, clients must authenticate using one of its username/password pairs.
+// Clients that do not complete the SOCKS5 handshake within 10 seconds are disconnected.
+// Access restrictions and connection limits are configured via options (see ListenOptions; OnDialFailure
+// does not apply to SOCKS5 listeners).
+func ListenSOCKS5Context(ctx context.Context, laddr net.Addr, config *Config, credentials map[string]string, options *ListenOptions) (*TunnelListener, chan error, error) {
+	tunnel := NewTunnel(config, 1)
+	listener, errCh, err := tunnel.listenSOCKS5(ctx, laddr, credentials, options, func() { tunnel.close() })
+	if err != nil {
+		tunnel.close()
+		return nil, nil, err
+	}
+	return listener, errCh, nil
+}
+
+// ListenSOCKS5 is ListenSOCKS5Context with context.Background()
+func (t *Tunnel) ListenSOCKS5(laddr net.Addr, credentials map[string]string, options *ListenOptions) (*TunnelListener, chan error, error) {
+	return t.ListenSOCKS5Context(context.Background(), laddr, credentials, options)
+}
+
+// ListenSOCKS5Context serves a SOCKS5 proxy on the given local network address `laddr`,
+// using the pooled SSH clients for the proxied connections.
+//
+// See func ListenSOCKS5Context for a description of the parameters.
+func (t *Tunnel) ListenSOCKS5Context(ctx context.Context, laddr net.Addr, credentials map[string]string, options *ListenOptions) (*TunnelListener, chan error, error) {
+	return t.listenSOCKS5(ctx, laddr, credentials, options, nil)
+}
+
+func (t *Tunnel) listenSOCKS5(ctx context.Context, laddr net.Addr, credentials map[string]string, options *ListenOptions, cleanup func()) (*TunnelListener, chan error, error) {
+	policy, err := newListenPolicy(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := listenLocal(laddr, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	handleListenerConn := func(ctx context.Context, listenerConn net.Conn, pipe connpipe.Config) error {
+		listenerConn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+		addr, err := socks5Handshake(listenerConn, credentials)
+		if err != nil {
+			return fmt.Errorf("socks5: %s: %v", listenerConn.RemoteAddr(), err)
+		}
+		listenerConn.SetDeadline(time.Time{})
+		tunnelConn, _, err := t.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			socks5Reply(listenerConn, socks5ReplyHostUnreachable)
+			return fmt.Errorf("socks5: dial %s: %v", addr, err)
+		}
+		defer tunnelConn.Close()
+		if err := socks5Reply(listenerConn, socks5ReplySucceeded); err != nil {
+			return nil
+		}
+		result := pipe.Run(ctx, tunnelConn, listenerConn)
+		observe(t.config.Observer, EventSessionEnded{RemoteAddr: listenerConn.RemoteAddr(), Result: result})
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	l, errCh := serve(ctx, cancel, listener, t.config.Observer, policy, handleListenerConn, cleanup)
+	return l, errCh, nil
+}
+
+// socks5Handshake performs method negotiation, authentication and reads a CONNECT request (RFC 1928, RFC 1929).
+// It returns the requested destination as a host:port address.
+func socks5Handshake(conn net.Conn, credentials map[string]string) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if credentials != nil {
+		method = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthUnavailable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthPassword {
+		if err := socks5Authenticate(conn, credentials); err != nil {
+			return "", err
+		}
+	}
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", err
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5ReplyAddrTypeNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	if request[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	portNumber := int(port[0])<<8 | int(port[1])
+	return net.JoinHostPort(host, strconv.Itoa(portNumber)), nil
+}
+
+func socks5Authenticate(conn net.Conn, credentials map[string]string) error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socks5AuthVersion {
+		return fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	var length [1]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	expected, ok := credentials[string(username)]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+		conn.Write([]byte{socks5AuthVersion, socks5ReplyGeneralFailure})
+		return fmt.Errorf("authentication failed for user %q", username)
+	}
+	_, err := conn.Write([]byte{socks5AuthVersion, socks5ReplySucceeded})
+	return err
+}
+
+// socks5Reply writes a reply with the given status code and an unspecified bind address.
+func socks5Reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socks5Version, status, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
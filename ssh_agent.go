@@ -0,0 +1,269 @@
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrAgentClosed is returned by Agent methods after the Agent has been closed.
+var ErrAgentClosed = errors.New("ssh: agent closed")
+
+// Agent is a long-lived connection to an ssh-agent.
+//
+// The connection is established on first use and re-established when it fails. It is closed
+// when the context passed to NewAgent is cancelled, or when Close is called.
+//
+// Agent implements agent.Agent, so it can be used for agent forwarding (see Config.ForwardAgent).
+type Agent struct {
+	config    ConfigSSHAgent
+	transient bool // disconnect after each request
+
+	mu     sync.Mutex // held for each round trip to the agent
+	client agent.ExtendedAgent
+
+	connMu sync.Mutex // guards conn and closed, so that Close can interrupt a round trip
+	conn   net.Conn
+	closed bool
+}
+
+// NewAgent returns an Agent for the given configuration.
+func NewAgent(ctx context.Context, config ConfigSSHAgent) *Agent {
+	a := &Agent{config: config}
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			a.Close()
+		}()
+	}
+	return a
+}
+
+// newTransientAgent returns an Agent that connects for each request and disconnects afterwards,
+// so that it holds no connection between uses and needs no closing.
+func newTransientAgent(config ConfigSSHAgent) *Agent {
+	return &Agent{config: config, transient: true}
+}
+
+// Close closes the agent connection, interrupting a pending request.
+func (a *Agent) Close() error {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	a.closed = true
+	if a.conn == nil {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn = nil
+	return err
+}
+
+// Signers returns signers for the agent's (matching) keys.
+//
+// The signers sign via the Agent, so they remain usable after the agent connection is
+// re-established, and unlock a locked agent using the configured passphrase if necessary.
+func (a *Agent) Signers() ([]ssh.Signer, error) {
+	keys, err := a.List()
+	if (err != nil || len(keys) == 0) && a.config.Passphrase != nil {
+		if errUnlock := a.Unlock(*a.config.Passphrase); errUnlock == nil {
+			keys, err = a.List()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []ssh.Signer
+	for _, key := range keys {
+		if !a.matches(key) {
+			continue
+		}
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &agentSigner{agent: a, pub: pub})
+	}
+	return out, nil
+}
+
+func (a *Agent) matches(key *agent.Key) bool {
+	if len(a.config.Comments) == 0 && len(a.config.Fingerprints) == 0 {
+		return true
+	}
+	for _, comment := range a.config.Comments {
+		if key.Comment == comment {
+			return true
+		}
+	}
+	for _, fingerprint := range a.config.Fingerprints {
+		if ssh.FingerprintSHA256(key) == fingerprint || ssh.FingerprintLegacyMD5(key) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the identities known to the agent.
+func (a *Agent) List() (keys []*agent.Key, err error) {
+	err = a.do(func(client agent.ExtendedAgent) (err error) {
+		keys, err = client.List()
+		return
+	})
+	return
+}
+
+// Sign has the agent sign the data using a protocol 2 key as defined in [PROTOCOL.agent] section 2.6.2.
+func (a *Agent) Sign(key ssh.PublicKey, data []byte) (sig *ssh.Signature, err error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs like Sign, but allows for additional flags to be sent/received.
+func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (sig *ssh.Signature, err error) {
+	err = a.do(func(client agent.ExtendedAgent) (err error) {
+		sig, err = client.SignWithFlags(key, data, flags)
+		return
+	})
+	if err != nil && a.config.Passphrase != nil {
+		// The agent may have been locked since the keys were listed.
+		if errUnlock := a.Unlock(*a.config.Passphrase); errUnlock == nil {
+			err = a.do(func(client agent.ExtendedAgent) (err error) {
+				sig, err = client.SignWithFlags(key, data, flags)
+				return
+			})
+		}
+	}
+	return
+}
+
+// Add adds a private key to the agent.
+func (a *Agent) Add(key agent.AddedKey) error {
+	return a.do(func(client agent.ExtendedAgent) error { return client.Add(key) })
+}
+
+// Remove removes all identities with the given public key.
+func (a *Agent) Remove(key ssh.PublicKey) error {
+	return a.do(func(client agent.ExtendedAgent) error { return client.Remove(key) })
+}
+
+// RemoveAll removes all identities.
+func (a *Agent) RemoveAll() error {
+	return a.do(func(client agent.ExtendedAgent) error { return client.RemoveAll() })
+}
+
+// Lock locks the agent. Sign and Remove will fail, and List will return an empty list.
+func (a *Agent) Lock(passphrase []byte) error {
+	return a.do(func(client agent.ExtendedAgent) error { return client.Lock(passphrase) })
+}
+
+// Unlock undoes the effect of Lock.
+func (a *Agent) Unlock(passphrase []byte) error {
+	return a.do(func(client agent.ExtendedAgent) error { return client.Unlock(passphrase) })
+}
+
+// do runs f with the agent client, (re-)connecting first if necessary.
+// If f fails due to a broken connection, it is retried once on a new connection.
+func (a *Agent) do(f func(agent.ExtendedAgent) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.transient {
+		defer a.disconnect()
+	}
+	for retried := false; ; retried = true {
+		if a.isClosed() {
+			a.client = nil
+			return ErrAgentClosed
+		}
+		if a.client == nil {
+			if err := a.connect(); err != nil {
+				return err
+			}
+		}
+		err := f(a.client)
+		if err != nil && a.isClosed() {
+			a.disconnect()
+			return ErrAgentClosed
+		}
+		if err == nil || !isConnError(err) {
+			return err
+		}
+		a.disconnect()
+		if retried {
+			return err
+		}
+	}
+}
+
+func (a *Agent) isClosed() bool {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	return a.closed
+}
+
+func (a *Agent) connect() error {
+	addr := a.config.Addr
+	if addr == nil {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return errors.New("ssh agent: no address given and SSH_AUTH_SOCK not set")
+		}
+		addr = &net.UnixAddr{Name: sock, Net: "unix"}
+	}
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		return fmt.Errorf("ssh agent: %v", err)
+	}
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	if a.closed {
+		conn.Close()
+		return ErrAgentClosed
+	}
+	a.conn, a.client = conn, agent.NewClient(conn)
+	return nil
+}
+
+func (a *Agent) disconnect() {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	a.conn, a.client = nil, nil
+}
+
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &opErr)
+}
+
+// agentSigner is an ssh.Signer for a key held by an Agent.
+type agentSigner struct {
+	agent *Agent
+	pub   ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.Sign(s.pub, data)
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	return s.agent.SignWithFlags(s.pub, data, flags)
+}
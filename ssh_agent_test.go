@@ -0,0 +1,118 @@
+package sshtunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newSilentAgent starts a unix socket server that accepts agent connections but never replies.
+func newSilentAgent(t *testing.T) net.Addr {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr()
+}
+
+func TestAgentCloseInterruptsRequest(t *testing.T) {
+	a := NewAgent(context.Background(), ConfigSSHAgent{Addr: newSilentAgent(t)})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.List()
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		a.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by a pending request")
+	}
+	select {
+	case err := <-errs:
+		if err != ErrAgentClosed {
+			t.Errorf("List = %v, want %v", err, ErrAgentClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("List not interrupted by Close")
+	}
+}
+
+// newKeyringAgent starts an ssh-agent server holding one key, counting its open connections.
+func newKeyringAgent(t *testing.T) (net.Addr, *int32) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var open int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&open, 1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				atomic.AddInt32(&open, -1)
+			}()
+		}
+	}()
+	return listener.Addr(), &open
+}
+
+func TestConfigSSHAgentKeysHoldNoConnection(t *testing.T) {
+	addr, open := newKeyringAgent(t)
+	keys, err := ConfigSSHAgent{Addr: addr}.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("%d keys, want 1", len(keys))
+	}
+	data := []byte("data")
+	signature, err := keys[0].Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys[0].PublicKey().Verify(data, signature); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(open) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d agent connections still open", atomic.LoadInt32(open))
+		}
+	}
+}
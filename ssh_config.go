@@ -0,0 +1,542 @@
+package sshtunnel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxSSHConfigDepth limits Include nesting and ProxyJump chains.
+const maxSSHConfigDepth = 16
+
+// defaultIdentityFiles are the keys tried when a host has no IdentityFile, as with OpenSSH.
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ecdsa_sk",
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ed25519_sk",
+	"~/.ssh/id_dsa",
+}
+
+// ConfigFromSSHConfig reads the OpenSSH client configuration file at `path` (such as ~/.ssh/config)
+// and returns the tunnel and authentication configuration for the host `alias`.
+//
+// The keywords Host, Include, HostName, Port, User, IdentityFile, IdentityAgent, ProxyJump,
+// UserKnownHostsFile, StrictHostKeyChecking, HashKnownHosts, ConnectTimeout, ServerAliveInterval,
+// ServerAliveCountMax, ForwardAgent and LocalForward are supported;
+// other keywords are ignored. Match blocks are not supported and never apply.
+//
+// The returned Config's SSHClient authenticates using the keys of the returned ConfigAuth,
+// which are loaded on each connection attempt, so the ConfigAuth may still be modified
+// (for example to add key passphrases) before connecting. Without IdentityFile, the default keys
+// (~/.ssh/id_rsa, ~/.ssh/id_ecdsa, ~/.ssh/id_ed25519, ...) are used. Keys that are missing or cannot be
+// loaded are skipped.
+func ConfigFromSSHConfig(path, alias string) (*Config, *ConfigAuth, error) {
+	lines, err := parseSSHConfig(path, filepath.Dir(path), nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, err := lines.host(alias, "", "", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	forwards, err := host.localForwards()
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &Config{
+		SSHAddr:       host.addr(),
+		SSHClient:     host.clientConfig,
+		LocalForwards: forwards,
+		KeepAlive:     host.keepAlive,
+	}
+	if host.forwardAgent != nil {
+		config.ForwardAgent = host.forwardAgent
+	}
+	for _, jump := range host.jumps {
+		config.Jumps = append(config.Jumps, JumpHost{
+			Addr:      jump.addr(),
+			SSHClient: jump.clientConfig,
+		})
+	}
+	return config, host.auth, nil
+}
+
+// sshConfigLine is a single directive from an OpenSSH client configuration file.
+type sshConfigLine struct {
+	// hosts are the patterns of the enclosing Host block, or nil outside of any block.
+	hosts []string
+	// match is set for directives inside a Match block.
+	match bool
+	// key is the lower-cased keyword.
+	key  string
+	args []string
+}
+
+type sshConfigLines []sshConfigLine
+
+// sshConfigHost is the resolved configuration of a single host.
+type sshConfigHost struct {
+	alias        string
+	hostname     string
+	port         string
+	user         string
+	lines        sshConfigLines
+	auth         *ConfigAuth
+	clientConfig *ssh.ClientConfig
+	jumps        []*sshConfigHost
+	forwardAgent *Agent
+	keepAlive    *ConfigKeepAlive
+}
+
+// sshConfigSigners returns the keys of the ConfigAuth like ConfigAuth.Signers, but skips keys that are
+// missing or unusable (such as encrypted keys without a passphrase), as OpenSSH does.
+// An agent error is only returned if no keys are left.
+func sshConfigSigners(auth *ConfigAuth) ([]ssh.Signer, error) {
+	keys, errAgent := ConfigAuth{SSHAgent: auth.SSHAgent, Agent: auth.Agent}.Signers()
+	for _, k := range auth.Keys {
+		key, err := k.Key()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && errAgent != nil {
+		return nil, errAgent
+	}
+	return keys, nil
+}
+
+func parseSSHConfig(path, dir string, hosts []string, depth int) (sshConfigLines, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("ssh config %s: too many nested includes", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out sshConfigLines
+	match := false
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		key, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("ssh config %s:%d: %v", path, lineNumber, err)
+		}
+		switch key {
+		case "":
+			continue
+		case "host":
+			hosts, match = args, false
+			continue
+		case "match":
+			hosts, match = nil, true
+			continue
+		case "include":
+			if match {
+				continue
+			}
+			for _, pattern := range args {
+				included, err := includeSSHConfig(path, dir, pattern, hosts, depth)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, included...)
+			}
+			continue
+		}
+		out = append(out, sshConfigLine{hosts: hosts, match: match, key: key, args: args})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ssh config %s: %v", path, err)
+	}
+	return out, nil
+}
+
+// includeSSHConfig parses the files matching an Include pattern.
+// Relative patterns are resolved against the directory `dir` of the top-level configuration file.
+func includeSSHConfig(path, dir, pattern string, hosts []string, depth int) (sshConfigLines, error) {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("ssh config %s: include %q: %v", path, pattern, err)
+	}
+	var out sshConfigLines
+	for _, includePath := range paths {
+		lines, err := parseSSHConfig(includePath, dir, hosts, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, lines...)
+	}
+	return out, nil
+}
+
+// splitSSHConfigLine splits a line into its lower-cased keyword and arguments.
+// The keyword may be separated from the arguments by whitespace or a single '='.
+// Arguments may be enclosed in double quotes.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case !quoted && r == '#' && !inArg:
+			return key, args, nil
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return "", nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return key, args, nil
+}
+
+// matchSSHConfigHost reports whether the alias matches a list of Host patterns.
+// A matching negated pattern (prefixed with '!') prevents a match.
+func matchSSHConfigHost(patterns []string, alias string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if !matchSSHConfigPattern(pattern, alias) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchSSHConfigPattern matches a single pattern with '*' and '?' wildcards.
+func matchSSHConfigPattern(pattern, s string) bool {
+	expr := regexp.QuoteMeta(strings.ToLower(pattern))
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	matched, _ := regexp.MatchString("^"+expr+"$", strings.ToLower(s))
+	return matched
+}
+
+// lookup returns the directives that apply to the given alias, in order.
+func (lines sshConfigLines) lookup(alias string) sshConfigLines {
+	var out sshConfigLines
+	for _, line := range lines {
+		if line.match {
+			continue
+		}
+		if line.hosts != nil && !matchSSHConfigHost(line.hosts, alias) {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// get returns the first value given for a keyword.
+func (lines sshConfigLines) get(key string) (string, bool) {
+	for _, line := range lines {
+		if line.key == key && len(line.args) > 0 {
+			return line.args[0], true
+		}
+	}
+	return "", false
+}
+
+// getAll returns the arguments of the first occurrence of a keyword.
+func (lines sshConfigLines) getAll(key string) []string {
+	for _, line := range lines {
+		if line.key == key {
+			return line.args
+		}
+	}
+	return nil
+}
+
+// each returns the arguments of all occurrences of a keyword.
+func (lines sshConfigLines) each(key string) [][]string {
+	var out [][]string
+	for _, line := range lines {
+		if line.key == key {
+			out = append(out, line.args)
+		}
+	}
+	return out
+}
+
+// host resolves the configuration for an alias. Non-empty user and port override the configured values.
+func (lines sshConfigLines) host(alias, userOverride, portOverride string, depth int) (*sshConfigHost, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("ssh config: host %q: ProxyJump chain too long", alias)
+	}
+	hostLines := lines.lookup(alias)
+	h := &sshConfigHost{alias: alias, lines: hostLines, port: "22"}
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	h.user = localUser
+	if v, ok := hostLines.get("user"); ok {
+		h.user = v
+	}
+	if userOverride != "" {
+		h.user = userOverride
+	}
+	if v, ok := hostLines.get("port"); ok {
+		h.port = v
+	}
+	if portOverride != "" {
+		h.port = portOverride
+	}
+	h.hostname = alias
+	if v, ok := hostLines.get("hostname"); ok {
+		h.hostname = expandSSHConfigTokens(v, map[byte]string{'h': alias})
+	}
+	tokens := map[byte]string{
+		'd': homeDir(),
+		'u': localUser,
+		'h': h.hostname,
+		'n': alias,
+		'p': h.port,
+		'r': h.user,
+	}
+
+	h.auth = &ConfigAuth{}
+	for _, args := range hostLines.each("identityfile") {
+		for _, arg := range args {
+			path := expandHome(expandSSHConfigTokens(arg, tokens))
+			h.auth.Keys = append(h.auth.Keys, KeySource{Path: &path})
+		}
+	}
+	if len(h.auth.Keys) == 0 {
+		for _, file := range defaultIdentityFiles {
+			path := expandHome(file)
+			h.auth.Keys = append(h.auth.Keys, KeySource{Path: &path})
+		}
+	}
+	agentAddr := os.Getenv("SSH_AUTH_SOCK")
+	if v, ok := hostLines.get("identityagent"); ok {
+		switch v {
+		case "none":
+			agentAddr = ""
+		case "SSH_AUTH_SOCK":
+		default:
+			agentAddr = expandHome(expandSSHConfigTokens(os.ExpandEnv(v), tokens))
+		}
+	}
+	if agentAddr != "" {
+		h.auth.SSHAgent = &ConfigSSHAgent{Addr: &net.UnixAddr{Name: agentAddr, Net: "unix"}}
+	}
+	if v, ok := hostLines.get("forwardagent"); ok && h.auth.SSHAgent != nil && strings.EqualFold(v, "yes") {
+		h.forwardAgent = newTransientAgent(*h.auth.SSHAgent)
+	}
+
+	hostKeyCallback, err := h.hostKeyCallback(tokens)
+	if err != nil {
+		return nil, err
+	}
+	auth := h.auth
+	h.clientConfig = &ssh.ClientConfig{
+		User: h.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return sshConfigSigners(auth)
+		})},
+		HostKeyCallback: hostKeyCallback,
+	}
+	if v, ok := hostLines.get("connecttimeout"); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("ssh config: host %q: ConnectTimeout %q: %v", alias, v, err)
+		}
+		h.clientConfig.Timeout = time.Duration(seconds) * time.Second
+	}
+
+	if v, ok := hostLines.get("serveraliveinterval"); ok && v != "0" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("ssh config: host %q: ServerAliveInterval %q: %v", alias, v, err)
+		}
+		h.keepAlive = &ConfigKeepAlive{Interval: time.Duration(seconds) * time.Second}
+		if v, ok := hostLines.get("serveralivecountmax"); ok {
+			if h.keepAlive.MaxMissed, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("ssh config: host %q: ServerAliveCountMax %q: %v", alias, v, err)
+			}
+		}
+	}
+
+	if v, ok := hostLines.get("proxyjump"); ok && v != "none" {
+		for _, spec := range strings.Split(v, ",") {
+			jumpUser, jumpHost, jumpPort := splitUserHostPort(spec)
+			jump, err := lines.host(jumpHost, jumpUser, jumpPort, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			h.jumps = append(h.jumps, jump.jumps...)
+			jump.jumps = nil
+			h.jumps = append(h.jumps, jump)
+		}
+	}
+	return h, nil
+}
+
+func (h *sshConfigHost) addr() string {
+	return net.JoinHostPort(h.hostname, h.port)
+}
+
+func (h *sshConfigHost) hostKeyCallback(tokens map[byte]string) (ssh.HostKeyCallback, error) {
+	strict, _ := h.lines.get("stricthostkeychecking")
+	switch strings.ToLower(strict) {
+	case "no", "off":
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	files := h.lines.getAll("userknownhostsfile")
+	if files == nil {
+		files = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	}
+	var policy HostKeyPolicy
+	for i, file := range files {
+		if file == "none" {
+			continue
+		}
+		file = expandHome(expandSSHConfigTokens(file, tokens))
+		if i == 0 && strings.EqualFold(strict, "accept-new") {
+			policy.TrustOnFirstUseFile = file
+			continue
+		}
+		if _, err := os.Stat(file); err == nil {
+			policy.KnownHostsFiles = append(policy.KnownHostsFiles, file)
+		}
+	}
+	if v, ok := h.lines.get("hashknownhosts"); ok {
+		policy.HashHostnames = strings.EqualFold(v, "yes")
+	}
+	callback, err := policy.Callback()
+	if err != nil {
+		return nil, fmt.Errorf("ssh config: host %q: %v", h.alias, err)
+	}
+	return callback, nil
+}
+
+// localForwards parses the LocalForward directives of the host.
+func (h *sshConfigHost) localForwards() ([]LocalForward, error) {
+	var out []LocalForward
+	for _, args := range h.lines.each("localforward") {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("ssh config: host %q: LocalForward: expected 2 arguments, got %d", h.alias, len(args))
+		}
+		var forward LocalForward
+		if strings.Contains(args[0], "/") {
+			forward.Local = &net.UnixAddr{Name: expandHome(args[0]), Net: "unix"}
+		} else {
+			localAddr := args[0]
+			if _, err := strconv.Atoi(localAddr); err == nil {
+				localAddr = net.JoinHostPort("127.0.0.1", localAddr)
+			}
+			tcpAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+			if err != nil {
+				return nil, fmt.Errorf("ssh config: host %q: LocalForward %q: %v", h.alias, args[0], err)
+			}
+			forward.Local = tcpAddr
+		}
+		forward.Network, forward.Addr = "tcp", args[1]
+		if strings.Contains(args[1], "/") {
+			forward.Network = "unix"
+		}
+		out = append(out, forward)
+	}
+	return out, nil
+}
+
+// splitUserHostPort splits a ProxyJump destination of the form [user@]host[:port].
+func splitUserHostPort(spec string) (userName, host, port string) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		userName, spec = spec[:i], spec[i+1:]
+	}
+	if h, p, err := net.SplitHostPort(spec); err == nil {
+		return userName, h, p
+	}
+	return userName, strings.Trim(spec, "[]"), ""
+}
+
+// expandSSHConfigTokens replaces %-tokens (such as %h) with the given values.
+func expandSSHConfigTokens(s string, tokens map[byte]string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if v, ok := tokens[s[i]]; ok {
+			out.WriteString(v)
+			continue
+		}
+		out.WriteByte('%')
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+func expandHome(path string) string {
+	if path == "~" {
+		return homeDir()
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(homeDir(), path[2:])
+	}
+	return path
+}
+
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return ""
+}
@@ -0,0 +1,277 @@
+package sshtunnel
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		key     string
+		args    []string
+		wantErr bool
+	}{
+		{line: ""},
+		{line: "   "},
+		{line: "# comment"},
+		{line: "  # indented comment"},
+		{line: "Host a b*", key: "host", args: []string{"a", "b*"}},
+		{line: "HostName=example.com", key: "hostname", args: []string{"example.com"}},
+		{line: "Port = 2222", key: "port", args: []string{"2222"}},
+		{line: "User\tdeploy", key: "user", args: []string{"deploy"}},
+		{line: "Compression", key: "compression"},
+		{line: `IdentityFile "/path with spaces/id_ed25519"`, key: "identityfile", args: []string{"/path with spaces/id_ed25519"}},
+		{line: `LocalForward 8080 "web:80"`, key: "localforward", args: []string{"8080", "web:80"}},
+		{line: "LocalForward 8080 web:80 # trailing comment", key: "localforward", args: []string{"8080", "web:80"}},
+		{line: "Host a#b", key: "host", args: []string{"a#b"}},
+		{line: `IdentityFile ""`, key: "identityfile", args: []string{""}},
+		{line: `IdentityFile "unterminated`, wantErr: true},
+	}
+	for _, test := range tests {
+		key, args, err := splitSSHConfigLine(test.line)
+		if (err != nil) != test.wantErr {
+			t.Errorf("splitSSHConfigLine(%q) error = %v, want error %v", test.line, err, test.wantErr)
+			continue
+		}
+		if key != test.key || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitSSHConfigLine(%q) = %q, %q, want %q, %q", test.line, key, args, test.key, test.args)
+		}
+	}
+}
+
+func TestMatchSSHConfigHost(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		alias    string
+		want     bool
+	}{
+		{[]string{"*"}, "anything", true},
+		{[]string{"web"}, "web", true},
+		{[]string{"web"}, "web2", false},
+		{[]string{"WEB"}, "web", true},
+		{[]string{"web?"}, "web1", true},
+		{[]string{"web?"}, "web10", false},
+		{[]string{"*.example.com"}, "db.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"a", "b"}, "b", true},
+		{[]string{"*", "!bastion"}, "bastion", false},
+		{[]string{"!bastion", "*"}, "bastion", false},
+		{[]string{"*", "!bastion"}, "web", true},
+		{[]string{"!bastion"}, "web", false},
+		{[]string{"web.+"}, "web.x", false},
+	}
+	for _, test := range tests {
+		if got := matchSSHConfigHost(test.patterns, test.alias); got != test.want {
+			t.Errorf("matchSSHConfigHost(%q, %q) = %v, want %v", test.patterns, test.alias, got, test.want)
+		}
+	}
+}
+
+func TestExpandSSHConfigTokens(t *testing.T) {
+	tokens := map[byte]string{'h': "example.com", 'p': "22", 'r': "deploy"}
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"%h", "example.com"},
+		{"~/.ssh/%r@%h:%p", "~/.ssh/deploy@example.com:22"},
+		{"100%%", "100%"},
+		{"%x", "%x"},
+		{"trailing%", "trailing%"},
+	}
+	for _, test := range tests {
+		if got := expandSSHConfigTokens(test.in, tokens); got != test.want {
+			t.Errorf("expandSSHConfigTokens(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSplitUserHostPort(t *testing.T) {
+	tests := []struct {
+		spec, user, host, port string
+	}{
+		{"bastion", "", "bastion", ""},
+		{"bastion:2222", "", "bastion", "2222"},
+		{"ops@bastion", "ops", "bastion", ""},
+		{" ops@bastion:2222 ", "ops", "bastion", "2222"},
+		{"[::1]:2222", "", "::1", "2222"},
+		{"ops@[::1]", "ops", "::1", ""},
+		{"a@b@bastion", "a@b", "bastion", ""},
+	}
+	for _, test := range tests {
+		user, host, port := splitUserHostPort(test.spec)
+		if user != test.user || host != test.host || port != test.port {
+			t.Errorf("splitUserHostPort(%q) = %q, %q, %q, want %q, %q, %q", test.spec, user, host, port, test.user, test.host, test.port)
+		}
+	}
+}
+
+// writeSSHConfig writes the files (relative paths to contents) into a new directory and returns it.
+// HOME is set to the directory and SSH_AUTH_SOCK is cleared.
+func writeSSHConfig(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func keyPaths(auth *ConfigAuth) []string {
+	var out []string
+	for _, key := range auth.Keys {
+		out = append(out, *key.Path)
+	}
+	return out
+}
+
+func TestConfigFromSSHConfig(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"config": strings.Join([]string{
+			"Include conf.d/*",
+			"",
+			"Match all",
+			"  User ignored",
+			"",
+			"Host web",
+			"  HostName %h.example.com",
+			"  User deploy",
+			"  Port 2222",
+			"  IdentityFile ~/.ssh/%r_%h",
+			"  ProxyJump ops@bastion:2200,inner",
+			"  LocalForward 8080 app:80",
+			"  LocalForward 127.0.0.1:9090 /run/app.sock",
+			"  ServerAliveInterval 15",
+			"  ServerAliveCountMax 4",
+			"  ConnectTimeout 5",
+			"",
+			"Host * !web",
+			"  User fallback",
+			"",
+			"Host *",
+			"  User last",
+			"  Port 2200",
+		}, "\n"),
+		"conf.d/bastion": "Host bastion\n  HostName 10.0.0.1\n",
+		"conf.d/inner":   "Host inner\n  HostName inner.internal\n  ProxyJump bastion\n",
+	})
+
+	config, auth, err := ConfigFromSSHConfig(filepath.Join(dir, "config"), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SSHAddr != "web.example.com:2222" {
+		t.Errorf("SSHAddr = %q", config.SSHAddr)
+	}
+	if config.SSHClient.User != "deploy" {
+		t.Errorf("User = %q", config.SSHClient.User)
+	}
+	if config.SSHClient.Timeout != 5*time.Second {
+		t.Errorf("Timeout = %v", config.SSHClient.Timeout)
+	}
+	if want := []string{filepath.Join(dir, ".ssh/deploy_web.example.com")}; !reflect.DeepEqual(keyPaths(auth), want) {
+		t.Errorf("keys = %q, want %q", keyPaths(auth), want)
+	}
+	if auth.SSHAgent != nil {
+		t.Errorf("SSHAgent = %+v, want nil", auth.SSHAgent)
+	}
+	if config.KeepAlive == nil || config.KeepAlive.Interval != 15*time.Second || config.KeepAlive.MaxMissed != 4 {
+		t.Errorf("KeepAlive = %+v", config.KeepAlive)
+	}
+
+	// ProxyJump chains are flattened: bastion, then inner (via bastion again), then the host.
+	var jumps []string
+	for _, jump := range config.Jumps {
+		jumps = append(jumps, jump.SSHClient.User+"@"+jump.Addr)
+	}
+	wantJumps := []string{"ops@10.0.0.1:2200", "fallback@10.0.0.1:2200", "fallback@inner.internal:2200"}
+	if !reflect.DeepEqual(jumps, wantJumps) {
+		t.Errorf("jumps = %q, want %q", jumps, wantJumps)
+	}
+
+	if len(config.LocalForwards) != 2 {
+		t.Fatalf("%d local forwards, want 2", len(config.LocalForwards))
+	}
+	tcpForward, unixForward := config.LocalForwards[0], config.LocalForwards[1]
+	if tcpForward.Local.String() != "127.0.0.1:8080" || tcpForward.Network != "tcp" || tcpForward.Addr != "app:80" {
+		t.Errorf("forward = %v %s://%s", tcpForward.Local, tcpForward.Network, tcpForward.Addr)
+	}
+	if unixForward.Local.String() != "127.0.0.1:9090" || unixForward.Network != "unix" || unixForward.Addr != "/run/app.sock" {
+		t.Errorf("forward = %v %s://%s", unixForward.Local, unixForward.Network, unixForward.Addr)
+	}
+}
+
+func TestConfigFromSSHConfigDefaults(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"config": "Host other\n  User someone\n",
+	})
+	config, auth, err := ConfigFromSSHConfig(filepath.Join(dir, "config"), "plain.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SSHAddr != "plain.example.com:22" {
+		t.Errorf("SSHAddr = %q", config.SSHAddr)
+	}
+	var want []string
+	for _, file := range defaultIdentityFiles {
+		want = append(want, filepath.Join(dir, strings.TrimPrefix(file, "~/")))
+	}
+	if !reflect.DeepEqual(keyPaths(auth), want) {
+		t.Errorf("keys = %q, want %q", keyPaths(auth), want)
+	}
+	if config.KeepAlive != nil || len(config.Jumps) != 0 || len(config.LocalForwards) != 0 {
+		t.Errorf("config = %+v", config)
+	}
+}
+
+func TestConfigFromSSHConfigIdentityAgent(t *testing.T) {
+	dir := writeSSHConfig(t, map[string]string{
+		"config": "Host a\n  IdentityAgent ~/agent.sock\n  ForwardAgent yes\nHost b\n  IdentityAgent none\n",
+	})
+	_, auth, err := ConfigFromSSHConfig(filepath.Join(dir, "config"), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &net.UnixAddr{Name: filepath.Join(dir, "agent.sock"), Net: "unix"}
+	if auth.SSHAgent == nil || !reflect.DeepEqual(auth.SSHAgent.Addr, want) {
+		t.Errorf("SSHAgent = %+v, want address %v", auth.SSHAgent, want)
+	}
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(dir, "env.sock"))
+	if _, auth, err = ConfigFromSSHConfig(filepath.Join(dir, "config"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if auth.SSHAgent != nil {
+		t.Errorf("SSHAgent = %+v, want nil", auth.SSHAgent)
+	}
+}
+
+func TestConfigFromSSHConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"unterminated quote": "Host a\n  User \"x\n",
+		"bad port forward":   "Host a\n  LocalForward 8080\n",
+		"bad timeout":        "Host a\n  ConnectTimeout soon\n",
+		"include loop":       "Include config\n",
+		"proxy jump loop":    "Host a\n  ProxyJump a\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := writeSSHConfig(t, map[string]string{"config": content})
+			if _, _, err := ConfigFromSSHConfig(filepath.Join(dir, "config"), "a"); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
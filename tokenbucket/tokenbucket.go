@@ -0,0 +1,120 @@
+// Package tokenbucket implements a token bucket rate limiter whose rate can be changed at runtime.
+package tokenbucket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket holding up to `burst` tokens, refilled at `rate` tokens per second.
+// A rate of zero or less means no limit.
+//
+// A Bucket is safe for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a full Bucket with the given rate (tokens per second) and burst size.
+// A burst size less than 1 is treated as 1.
+func New(rate float64, burst int) *Bucket {
+	b := &Bucket{last: time.Now()}
+	b.SetRate(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate changes the rate (tokens per second) and burst size of the bucket.
+// Waits already in progress are not affected.
+func (b *Bucket) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Rate returns the current rate (tokens per second) and burst size of the bucket.
+func (b *Bucket) Rate() (float64, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate, int(b.burst)
+}
+
+// Allow is AllowN(1)
+func (b *Bucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens if they are available now, and reports whether it did.
+func (b *Bucket) AllowN(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Wait is WaitN(ctx, 1)
+func (b *Bucket) Wait(ctx context.Context) error {
+	return b.WaitN(ctx, 1)
+}
+
+// WaitN takes n tokens, waiting until they have been refilled if necessary. n may exceed the burst size.
+// If the context is cancelled first, the tokens are returned to the bucket and the context's error is returned.
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += float64(n)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// refill adds the tokens accumulated since the last refill. The caller must hold b.mu.
+func (b *Bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
@@ -0,0 +1,95 @@
+package tokenbucket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketUnlimited(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		b := New(rate, 0)
+		if !b.AllowN(1 << 30) {
+			t.Errorf("rate %v: AllowN refused", rate)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := b.WaitN(ctx, 1<<30); err != nil {
+			t.Errorf("rate %v: WaitN = %v", rate, err)
+		}
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	b := New(10, 5)
+	if !b.AllowN(5) {
+		t.Fatal("a full bucket refused its burst size")
+	}
+	if b.Allow() {
+		t.Fatal("an empty bucket allowed a token")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("a token was not refilled")
+	}
+}
+
+func TestBucketWaitN(t *testing.T) {
+	b := New(1000, 100)
+	start := time.Now()
+	if err := b.WaitN(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("waited %v for the burst", elapsed)
+	}
+	// More than the burst size: waits for the debt to be refilled.
+	start = time.Now()
+	if err := b.WaitN(context.Background(), 150); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 130*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waited %v for 150 tokens at 1000/s", elapsed)
+	}
+}
+
+func TestBucketWaitNCancelRefunds(t *testing.T) {
+	b := New(1000, 1000)
+	if err := b.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.WaitN(ctx, 1000); err != context.DeadlineExceeded {
+		t.Fatalf("WaitN = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Without the refund, the next wait would have to pay for the cancelled one as well.
+	start := time.Now()
+	if err := b.WaitN(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %v for 100 tokens after a cancelled wait", elapsed)
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	b := New(100, 100)
+	b.SetRate(100, 10)
+	if rate, burst := b.Rate(); rate != 100 || burst != 10 {
+		t.Errorf("Rate = %v, %v, want 100, 10", rate, burst)
+	}
+	if b.AllowN(11) {
+		t.Error("tokens were not limited to the new burst size")
+	}
+	if !b.AllowN(10) {
+		t.Error("the new burst size was refused")
+	}
+	b.SetRate(0, 0)
+	if rate, burst := b.Rate(); rate != 0 || burst != 1 {
+		t.Errorf("Rate = %v, %v, want 0, 1", rate, burst)
+	}
+	if !b.AllowN(1000) {
+		t.Error("an unlimited bucket refused tokens")
+	}
+}
@@ -0,0 +1,271 @@
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sgreben/sshtunnel/backoff"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrTunnelClosed is returned by Tunnel methods after the Tunnel has been closed.
+var ErrTunnelClosed = errors.New("ssh: tunnel closed")
+
+// Tunnel is a pool of SSH client connections for a single Config.
+//
+// Tunneled connections opened via a Tunnel are multiplexed as channels over the
+// pooled SSH clients instead of performing a new SSH handshake per connection.
+// Pooled clients that drop are re-connected transparently on next use.
+type Tunnel struct {
+	config *Config
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	slots []*tunnelSlot
+	next  int
+}
+
+type tunnelSlot struct {
+	mu         sync.Mutex
+	client     *tunnelClient
+	connecting chan struct{} // closed when the current connection attempt has finished
+}
+
+// tunnelClient is a pooled SSH client. Its wait channel receives its termination error and is closed
+// once it disconnects, just before done is closed.
+type tunnelClient struct {
+	*ssh.Client
+	wait   chan error
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// NewTunnel returns a Tunnel that keeps up to `size` SSH clients for the given configuration.
+// Clients are connected lazily. A size less than 1 is treated as 1.
+func NewTunnel(config *Config, size int) *Tunnel {
+	if size < 1 {
+		size = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Tunnel{
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make([]*tunnelSlot, size),
+	}
+	for i := range t.slots {
+		t.slots[i] = &tunnelSlot{}
+	}
+	return t
+}
+
+// Client returns a connected SSH client from the pool, connecting it first if necessary.
+//
+// The returned channel receives the client's termination error once it disconnects, and is closed afterwards.
+// It is shared by all callers using the same pooled client, so that only one of them receives the error.
+func (t *Tunnel) Client(ctx context.Context) (*ssh.Client, <-chan error, error) {
+	client, err := t.nextSlot().get(ctx, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client.Client, client.wait, nil
+}
+
+// Dial opens a tunnelled connection to the address on the named network
+// over one of the pooled SSH clients.
+//
+// See func Dial for a description of the network and address parameters.
+func (t *Tunnel) Dial(network, addr string) (net.Conn, <-chan error, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+// DialContext opens a tunnelled connection to the address on the named network
+// over one of the pooled SSH clients using the provided context.
+//
+// The returned channel is the pooled client's channel, see Tunnel.Client.
+//
+// See func Dial for a description of the network and address parameters.
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, <-chan error, error) {
+	if ctx == nil {
+		panic("nil context")
+	}
+	slot := t.nextSlot()
+	for retried := false; ; retried = true {
+		client, err := slot.get(ctx, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		start := time.Now()
+		conn, err := dialChannel(ctx, client.Client, network, addr)
+		if err == nil {
+			return newDeadlineConn(observeConn(conn, t.config.Observer, network, addr, start)), client.wait, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		select {
+		case <-client.done:
+			// The pooled client dropped while dialling; retry once with a fresh one.
+			if !retried {
+				continue
+			}
+		default:
+		}
+		return nil, nil, err
+	}
+}
+
+// ReDial is ReDialContext with context.Background()
+func (t *Tunnel) ReDial(network, addr string, backoffConfig backoff.Config) (<-chan net.Conn, <-chan error) {
+	return t.ReDialContext(context.Background(), network, addr, backoffConfig)
+}
+
+// ReDialContext opens tunnelled connections over the pooled SSH clients.
+//
+// See func ReDialContext for a description of the parameters.
+func (t *Tunnel) ReDialContext(ctx context.Context, network, addr string, backoffConfig backoff.Config) (<-chan net.Conn, <-chan error) {
+	dial := func() (net.Conn, <-chan error, error) {
+		return t.DialContext(ctx, network, addr)
+	}
+	return reDial(ctx, dial, backoffConfig, t.config.Observer)
+}
+
+// Listen is ListenContext with context.Background()
+func (t *Tunnel) Listen(laddr net.Addr, network, addr string, reconnectBackoff backoff.Config, options *ListenOptions) (*TunnelListener, chan error, error) {
+	return t.ListenContext(context.Background(), laddr, network, addr, reconnectBackoff, options)
+}
+
+// ListenContext serves an SSH tunnel to a remote address on the given local network address `laddr`,
+// using the pooled SSH clients for the tunneled connections.
+// The pooled SSH clients are not closed when the listener is closed or shut down.
+//
+// See func ListenWithOptionsContext for a description of the parameters.
+func (t *Tunnel) ListenContext(ctx context.Context, laddr net.Addr, network, addr string, reconnectBackoff backoff.Config, options *ListenOptions) (*TunnelListener, chan error, error) {
+	return t.listen(ctx, laddr, network, addr, reconnectBackoff, options, nil)
+}
+
+// Close closes all pooled SSH clients. Connections tunneled over them are closed as well.
+func (t *Tunnel) Close() error {
+	err := t.close()
+	observe(t.config.Observer, EventTunnelClosed{Cause: ErrTunnelClosed})
+	return err
+}
+
+// close is Close without emitting EventTunnelClosed, for owners that emit it themselves.
+func (t *Tunnel) close() error {
+	t.cancel()
+	var firstErr error
+	for _, slot := range t.slots {
+		slot.mu.Lock()
+		if slot.client != nil {
+			if err := slot.client.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		slot.mu.Unlock()
+	}
+	return firstErr
+}
+
+func (t *Tunnel) nextSlot() *tunnelSlot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot := t.slots[t.next%len(t.slots)]
+	t.next++
+	return slot
+}
+
+// get returns the slot's client, (re-)connecting it if it is missing or has disconnected.
+// One caller at a time connects the slot; the others wait for it to finish, or for their context.
+func (s *tunnelSlot) get(ctx context.Context, t *Tunnel) (*tunnelClient, error) {
+	for {
+		s.mu.Lock()
+		select {
+		case <-t.ctx.Done():
+			s.mu.Unlock()
+			return nil, ErrTunnelClosed
+		case <-ctx.Done():
+			s.mu.Unlock()
+			return nil, ctx.Err()
+		default:
+		}
+		if client := s.client; client != nil && !isClosedChan(client.done) {
+			s.mu.Unlock()
+			return client, nil
+		}
+		if connecting := s.connecting; connecting != nil {
+			s.mu.Unlock()
+			select {
+			case <-connecting:
+				continue
+			case <-t.ctx.Done():
+				return nil, ErrTunnelClosed
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		connecting := make(chan struct{})
+		s.connecting = connecting
+		s.mu.Unlock()
+
+		client, err := t.connect(ctx)
+		s.mu.Lock()
+		s.connecting = nil
+		if err == nil {
+			s.client = client
+		}
+		s.mu.Unlock()
+		close(connecting)
+		return client, err
+	}
+}
+
+// connect opens a pooled SSH client. The connection attempt is abandoned when either ctx or the Tunnel's
+// context is done; once connected, the client lives until it disconnects or the Tunnel is closed.
+func (t *Tunnel) connect(ctx context.Context) (*tunnelClient, error) {
+	connectCtx, cancel := context.WithCancel(t.ctx)
+	var mu sync.Mutex
+	connecting := true
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if connecting {
+				cancel()
+			}
+			mu.Unlock()
+		case <-stop:
+		}
+	}()
+	client, wait, err := connectSSH(connectCtx, t.config)
+	mu.Lock()
+	connecting = false
+	mu.Unlock()
+	close(stop)
+	if err == nil && connectCtx.Err() != nil {
+		err = connectCtx.Err() // cancelled just after connecting; the client is being closed
+	}
+	if err != nil {
+		cancel()
+		switch {
+		case t.ctx.Err() != nil:
+			return nil, ErrTunnelClosed
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c := &tunnelClient{Client: client, wait: make(chan error, 1), done: make(chan struct{}), cancel: cancel}
+	go func() {
+		c.wait <- <-wait
+		close(c.wait)
+		close(c.done)
+		c.cancel()
+	}()
+	return c, nil
+}
@@ -0,0 +1,342 @@
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgreben/sshtunnel/connpipe"
+	"github.com/sgreben/sshtunnel/tokenbucket"
+)
+
+// TunnelListener is a local listener serving tunneled connections (see ListenWithOptionsContext).
+type TunnelListener struct {
+	listener net.Listener
+	cancel   context.CancelFunc
+	sessions sync.WaitGroup
+	done     chan struct{} // closed after all sessions have ended and the tunnel has been torn down
+
+	rateIn  *tokenbucket.Bucket // aggregate limit of data received from clients
+	rateOut *tokenbucket.Bucket // aggregate limit of data sent to clients
+
+	mu          sync.Mutex
+	conns       map[uint64]*listenerConn
+	nextID      uint64
+	accepted    uint64
+	bytesIn     int64 // bytes received from closed connections
+	bytesOut    int64 // bytes sent to closed connections
+	connRateIn  float64
+	connRateOut float64
+}
+
+// ListenerConn describes an active connection served by a TunnelListener.
+//
+// The SSH channel carrying a connection has no identifier exposed by golang.org/x/crypto/ssh;
+// ID identifies the connection within its listener instead.
+type ListenerConn struct {
+	ID         uint64
+	RemoteAddr net.Addr // the client's address
+	Start      time.Time
+	BytesIn    int64 // bytes received from the client
+	BytesOut   int64 // bytes sent to the client
+}
+
+// ListenerStats are aggregate statistics of a TunnelListener.
+// The byte counts include both active and closed connections.
+type ListenerStats struct {
+	Active   int
+	Accepted uint64
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Addr returns the listener's local network address.
+func (l *TunnelListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Conns returns a snapshot of the active connections, ordered by ID.
+func (l *TunnelListener) Conns() []ListenerConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]ListenerConn, 0, len(l.conns))
+	for _, conn := range l.conns {
+		out = append(out, conn.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// CloseConn closes the active connection with the given ID (see Conns).
+func (l *TunnelListener) CloseConn(id uint64) error {
+	l.mu.Lock()
+	conn, ok := l.conns[id]
+	l.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no active connection with id %d", id)
+	}
+	return conn.Close()
+}
+
+// Stats returns aggregate statistics of the listener.
+func (l *TunnelListener) Stats() ListenerStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := ListenerStats{
+		Active:   len(l.conns),
+		Accepted: l.accepted,
+		BytesIn:  l.bytesIn,
+		BytesOut: l.bytesOut,
+	}
+	for _, conn := range l.conns {
+		stats.BytesIn += atomic.LoadInt64(&conn.bytesIn)
+		stats.BytesOut += atomic.LoadInt64(&conn.bytesOut)
+	}
+	return stats
+}
+
+// SetRateLimit changes the aggregate rate limits (in bytes per second, 0 for no limit)
+// of data received from (in) and sent to (out) all clients of the listener.
+func (l *TunnelListener) SetRateLimit(in, out float64) {
+	l.rateIn.SetRate(in, rateBurst(in))
+	l.rateOut.SetRate(out, rateBurst(out))
+}
+
+// SetConnRateLimit changes the rate limits (in bytes per second, 0 for no limit) of data received
+// from (in) and sent to (out) each client connection, including the active connections.
+func (l *TunnelListener) SetConnRateLimit(in, out float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.connRateIn, l.connRateOut = in, out
+	for _, conn := range l.conns {
+		conn.rateIn.SetRate(in, rateBurst(in))
+		conn.rateOut.SetRate(out, rateBurst(out))
+	}
+}
+
+// rateBurst returns the token bucket burst size for a rate limit, allowing one second's worth of data at once.
+func rateBurst(rate float64) int {
+	return int(rate)
+}
+
+// Close closes the listener and all active tunneled connections immediately.
+func (l *TunnelListener) Close() error {
+	l.cancel()
+	err := l.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the listener: it stops accepting new connections, waits for the
+// active tunneled connections to end, and then closes the tunnel's SSH connections.
+//
+// If the context expires first, the remaining connections are closed and the context's error is returned.
+func (l *TunnelListener) Shutdown(ctx context.Context) error {
+	err := l.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	select {
+	case <-l.done:
+		return err
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// track registers an accepted connection, returning it wrapped for byte counting.
+func (l *TunnelListener) track(conn net.Conn) *listenerConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	l.accepted++
+	c := &listenerConn{
+		Conn:    conn,
+		id:      l.nextID,
+		start:   time.Now(),
+		rateIn:  tokenbucket.New(l.connRateIn, rateBurst(l.connRateIn)),
+		rateOut: tokenbucket.New(l.connRateOut, rateBurst(l.connRateOut)),
+	}
+	l.conns[c.id] = c
+	return c
+}
+
+func (l *TunnelListener) untrack(c *listenerConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c.id)
+	l.bytesIn += atomic.LoadInt64(&c.bytesIn)
+	l.bytesOut += atomic.LoadInt64(&c.bytesOut)
+}
+
+// listenerConn is a connection accepted by a TunnelListener.
+type listenerConn struct {
+	net.Conn
+	id       uint64
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+	rateIn   *tokenbucket.Bucket
+	rateOut  *tokenbucket.Bucket
+}
+
+func (c *listenerConn) info() ListenerConn {
+	return ListenerConn{
+		ID:         c.id,
+		RemoteAddr: c.RemoteAddr(),
+		Start:      c.start,
+		BytesIn:    atomic.LoadInt64(&c.bytesIn),
+		BytesOut:   atomic.LoadInt64(&c.bytesOut),
+	}
+}
+
+func (c *listenerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *listenerConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+func (c *listenerConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.New("listenerConn: CloseWrite not supported")
+}
+
+// serve accepts connections from the listener and runs handle for each permitted and admitted connection in its own goroutine,
+// until the context is cancelled or the listener is closed. handle is passed the connection's connpipe configuration. Accepted connections are closed after handle
+// returns; errors returned by handle and rejected connections are reported to the observer and sent on the
+// returned channel without blocking.
+//
+// After the accept loop has ended and all handlers have returned, cancel and cleanup (if non-nil) are called.
+func serve(ctx context.Context, cancel context.CancelFunc, listener net.Listener, observer Observer, policy *listenPolicy, handle func(context.Context, net.Conn, connpipe.Config) error, cleanup func()) (*TunnelListener, chan error) {
+	l := &TunnelListener{
+		listener:    listener,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		rateIn:      tokenbucket.New(policy.rateIn, rateBurst(policy.rateIn)),
+		rateOut:     tokenbucket.New(policy.rateOut, rateBurst(policy.rateOut)),
+		conns:       make(map[uint64]*listenerConn),
+		connRateIn:  policy.connRateIn,
+		connRateOut: policy.connRateOut,
+	}
+	admission := policy.admission
+	admissionCtx, stopAdmission := context.WithCancel(ctx)
+	listenerConnsCh, listenerErrCh := listenerConns(ctx, listener)
+	errs := newErrorReporter()
+	reportErr := errs.report
+	reject := func(conn net.Conn, reason error) {
+		conn.Close()
+		observe(observer, EventListenerRejected{LocalAddr: conn.LocalAddr(), RemoteAddr: conn.RemoteAddr(), Reason: reason})
+		reportErr(fmt.Errorf("reject %s: %w", conn.RemoteAddr(), reason))
+	}
+	handleListenerConn := func(conn net.Conn) {
+		defer l.sessions.Done()
+		release, err := admission.admit(admissionCtx, conn)
+		if err != nil {
+			if admissionCtx.Err() != nil {
+				conn.Close() // the listener is shutting down
+				return
+			}
+			reject(conn, err)
+			return
+		}
+		defer release()
+		listenerConn := l.track(conn)
+		defer l.untrack(listenerConn)
+		defer listenerConn.Close()
+		servedConn, err := policy.serverTLS(ctx, listenerConn)
+		if err != nil {
+			observe(observer, EventError{Err: err})
+			reportErr(err)
+			return
+		}
+		defer servedConn.Close()
+		if err := policy.access.authorizeConn(servedConn); err != nil {
+			reject(listenerConn, err)
+			return
+		}
+		// The tunneled connection is A, the served connection B (see connpipe.Config).
+		pipe := policy.pipe
+		pipe.LimitAtoB = []*tokenbucket.Bucket{listenerConn.rateOut, l.rateOut}
+		pipe.LimitBtoA = []*tokenbucket.Bucket{listenerConn.rateIn, l.rateIn}
+		if err := handle(ctx, servedConn, pipe); err != nil {
+			observe(observer, EventError{Err: err})
+			reportErr(err)
+		}
+	}
+	go func() {
+		var cause error
+		defer func() { observe(observer, EventTunnelClosed{Cause: cause}) }()
+		defer func() {
+			listener.Close()
+			stopAdmission()
+			sessionsDone := make(chan struct{})
+			go func() {
+				l.sessions.Wait()
+				close(sessionsDone)
+			}()
+			var cleanupOnce sync.Once
+			closeTunnel := func() {
+				if cleanup != nil {
+					cleanupOnce.Do(cleanup)
+				}
+			}
+			select {
+			case <-sessionsDone:
+			case <-ctx.Done():
+				// Closed (or shut down past its deadline): tear down the tunnel first, so that
+				// sessions still connecting it return.
+				closeTunnel()
+				<-sessionsDone
+			}
+			cancel()
+			closeTunnel()
+			close(l.done)
+			errs.close(cause)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				cause = ctx.Err()
+				return
+			case err, ok := <-listenerErrCh:
+				if ok {
+					cause = err
+				}
+				return
+			case listenerConn, ok := <-listenerConnsCh:
+				if !ok {
+					return
+				}
+				observe(observer, EventListenerAccepted{LocalAddr: listenerConn.LocalAddr(), RemoteAddr: listenerConn.RemoteAddr()})
+				// Denied connections are rejected before they can use up the accept rate.
+				if err := policy.access.check(listenerConn); err != nil {
+					reject(listenerConn, err)
+					continue
+				}
+				if err := admission.accept(admissionCtx); err != nil {
+					reject(listenerConn, err)
+					continue
+				}
+				l.sessions.Add(1)
+				go handleListenerConn(listenerConn)
+			}
+		}
+	}()
+	return l, errs.ch
+}
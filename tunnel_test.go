@@ -0,0 +1,105 @@
+package sshtunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSilentServer starts a TCP server that accepts connections but never speaks SSH.
+func newSilentServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func silentServerConfig(t *testing.T) *Config {
+	return &Config{
+		SSHAddr:   newSilentServer(t),
+		SSHClient: &ssh.ClientConfig{User: "user", HostKeyCallback: ssh.InsecureIgnoreHostKey()},
+	}
+}
+
+func TestTunnelDialContextCancelsConnect(t *testing.T) {
+	tunnel := NewTunnel(silentServerConfig(t), 1)
+	defer tunnel.Close()
+
+	const callers = 3
+	errs := make(chan error, callers)
+	start := time.Now()
+	for i := 0; i < callers; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, _, err := tunnel.DialContext(ctx, "tcp", "127.0.0.1:7")
+			errs <- err
+		}()
+	}
+	for i := 0; i < callers; i++ {
+		select {
+		case err := <-errs:
+			if err != context.DeadlineExceeded {
+				t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("DialContext did not return after its deadline")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DialContext returned after %v", elapsed)
+	}
+}
+
+func TestTunnelCloseCancelsConnect(t *testing.T) {
+	tunnel := NewTunnel(silentServerConfig(t), 1)
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := tunnel.DialContext(context.Background(), "tcp", "127.0.0.1:7")
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	tunnel.Close()
+	select {
+	case err := <-errs:
+		if err != ErrTunnelClosed {
+			t.Errorf("err = %v, want %v", err, ErrTunnelClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DialContext did not return after Close")
+	}
+}
+
+func TestConnectSSHKeepAliveInterval(t *testing.T) {
+	config := silentServerConfig(t)
+	config.KeepAlive = &ConfigKeepAlive{MaxMissed: 2}
+	if _, _, err := connectSSH(context.Background(), config); err == nil {
+		t.Fatal("expected an error for a zero keepalive interval")
+	}
+}
@@ -0,0 +1,90 @@
+package sshtunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenLocal listens on the given local address, applying the unix socket options for unix addresses.
+func listenLocal(laddr net.Addr, options *ListenOptions) (net.Listener, error) {
+	network, addr := laddr.Network(), laddr.String()
+	listener, err := listenLocalSocket(network, addr, options)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s://%s: %v", network, addr, err)
+	}
+	return listener, nil
+}
+
+func listenLocalSocket(network, addr string, options *ListenOptions) (net.Listener, error) {
+	isSocketFile := (network == "unix" || network == "unixpacket") && !strings.HasPrefix(addr, "@")
+	if !isSocketFile || options == nil {
+		return net.Listen(network, addr)
+	}
+	if options.CreateSocketDir {
+		if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if options.RemoveStaleSocket {
+		if err := removeStaleSocket(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(true)
+	}
+	if options.SocketMode != 0 {
+		if err := os.Chmod(addr, options.SocketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if options.SocketUID != nil || options.SocketGID != nil {
+		uid, gid := -1, -1
+		if options.SocketUID != nil {
+			uid = *options.SocketUID
+		}
+		if options.SocketGID != nil {
+			gid = *options.SocketGID
+		}
+		if err := os.Chown(addr, uid, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at addr if no process accepts connections on it.
+// Files that are not sockets are never removed.
+func removeStaleSocket(network, addr string) error {
+	info, err := os.Lstat(addr)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", addr)
+	}
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", addr)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("check socket %s: %v", addr, err)
+	}
+	return os.Remove(addr)
+}